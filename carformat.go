@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/multiformats/go-multicodec"
+)
+
+const (
+	carFormatV1        = "v1"
+	carFormatV2        = "v2"
+	carFormatV2Sidecar = "v2-sidecar"
+)
+
+var carFormats = []string{carFormatV1, carFormatV2, carFormatV2Sidecar}
+
+// carFormat is the container the DAG is written in.
+type carFormat struct {
+	// Format is one of carFormats. v2-sidecar writes a CARv2 without an
+	// index and the index next to it, in <car>.idx.
+	Format string
+	// IndexCodec is the multicodec name of the CARv2 index, ignored for v1.
+	IndexCodec string
+}
+
+func defaultCARFormat() carFormat {
+	return carFormat{
+		Format:     carFormatV2,
+		IndexCodec: multicodec.CarMultihashIndexSorted.String(),
+	}
+}
+
+func (f carFormat) validate() error {
+	switch f.Format {
+	case carFormatV1, carFormatV2, carFormatV2Sidecar:
+	default:
+		return fmt.Errorf("unknown car format %q, must be one of: %s", f.Format, strings.Join(carFormats, ", "))
+	}
+	_, err := f.indexCodec()
+	return err
+}
+
+func (f carFormat) indexCodec() (multicodec.Code, error) {
+	var codec multicodec.Code
+	if err := codec.Set(f.IndexCodec); err != nil {
+		return 0, fmt.Errorf("index codec: %w", err)
+	}
+	if codec != multicodec.CarIndexSorted && codec != multicodec.CarMultihashIndexSorted {
+		return 0, fmt.Errorf("unsupported index codec %s, must be one of: %s, %s", codec, multicodec.CarIndexSorted, multicodec.CarMultihashIndexSorted)
+	}
+	return codec, nil
+}
+
+func (f carFormat) options() ([]car.Option, error) {
+	codec, err := f.indexCodec()
+	if err != nil {
+		return nil, err
+	}
+	return []car.Option{
+		blockstore.UseWholeCIDs(true),
+		blockstore.WriteAsCarV1(f.Format == carFormatV1),
+		car.UseIndexCodec(codec),
+	}, nil
+}
+
+// sidecarIndexPath is where the index of a v2-sidecar CAR is written.
+func sidecarIndexPath(carPath string) string {
+	return carPath + ".idx"
+}
+
+// detachCARIndex moves the index embedded in a CARv2 into its sidecar file and
+// truncates the CAR right after its data.
+func detachCARIndex(path string) error {
+	r, err := car.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close() // nolint:errcheck
+
+	header := r.Header
+	if !header.HasIndex() {
+		return fmt.Errorf("car %s has no index", path)
+	}
+
+	ir, err := r.IndexReader()
+	if err != nil {
+		return err
+	}
+	idx, err := os.Create(sidecarIndexPath(path))
+	if err != nil {
+		return err
+	}
+	defer idx.Close() // nolint:errcheck
+	if _, err := io.Copy(idx, ir); err != nil {
+		return err
+	}
+	if err := idx.Sync(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint:errcheck
+
+	if err := f.Truncate(int64(header.DataOffset + header.DataSize)); err != nil {
+		return err
+	}
+	header.IndexOffset = 0
+	if _, err := header.WriteTo(io.NewOffsetWriter(f, car.PragmaSize)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
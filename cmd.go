@@ -6,7 +6,10 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
-const DealProtocolv120 = "/fil/storage/mk/1.2.0"
+const (
+	DealProtocolv120 = "/fil/storage/mk/1.2.0"
+	AskProtocolv110  = "/fil/storage/ask/1.1.0"
+)
 
 func before(cctx *cli.Context) error {
 	_ = logging.SetLogLevel("pledge", "INFO")
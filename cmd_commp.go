@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/filecoin-project/go-commp-utils/writer"
+	"github.com/urfave/cli/v2"
+)
+
+var commPCmd = &cli.Command{
+	Name:      "commp",
+	Usage:     "Calculate the piece commitment of a car file",
+	ArgsUsage: "<file>",
+	Before:    before,
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "workers",
+			Usage: "number of goroutines hashing the piece commitment in parallel",
+			Value: runtime.NumCPU(),
+		},
+		&cli.BoolFlag{
+			Name:  "bench",
+			Usage: "also calculate it with the single stream writer and compare the results and durations",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		afmt := NewAppFmt(cctx.App)
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify the file")
+		}
+		file := cctx.Args().First()
+
+		start := time.Now()
+		cp, err := commP(file, cctx.Int("workers"))
+		if err != nil {
+			return err
+		}
+		took := time.Since(start)
+
+		afmt.Printf("Piece CID:  %s\n", cp.CommPCid)
+		afmt.Printf("Piece size: %d\n", cp.PieceSize)
+		afmt.Printf("Car size:   %d\n", cp.CarFileSize)
+
+		if !cctx.Bool("bench") {
+			return nil
+		}
+
+		start = time.Now()
+		ref, err := commPWriterSum(file)
+		if err != nil {
+			return err
+		}
+		refTook := time.Since(start)
+
+		afmt.Printf("\n%-10s %-12s %s\n", "", "duration", "throughput")
+		afmt.Printf("%-10s %-12s %s/s\n", "writer", refTook.Round(time.Millisecond), units.BytesSize(float64(cp.CarFileSize)/refTook.Seconds()))
+		afmt.Printf("%-10s %-12s %s/s\n", fmt.Sprintf("%d workers", cctx.Int("workers")), took.Round(time.Millisecond), units.BytesSize(float64(cp.CarFileSize)/took.Seconds()))
+		afmt.Printf("speedup: %.2fx\n", refTook.Seconds()/took.Seconds())
+
+		if ref.CommPCid != cp.CommPCid || ref.PieceSize != cp.PieceSize {
+			return fmt.Errorf("piece commitment mismatch: writer got %s (%d), workers got %s (%d)", ref.CommPCid, ref.PieceSize, cp.CommPCid, cp.PieceSize)
+		}
+		return nil
+	},
+}
+
+// commPWriterSum calculates the piece commitment with writer.Writer, reading
+// the file as a single stream.
+func commPWriterSum(filePath string) (*commpResult, error) {
+	rdr, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close() // nolint:errcheck
+
+	w := &writer.Writer{}
+	n, err := io.CopyBuffer(w, rdr, make([]byte, writer.CommPBuf))
+	if err != nil {
+		return nil, err
+	}
+	cp, err := w.Sum()
+	if err != nil {
+		return nil, err
+	}
+
+	return &commpResult{
+		CommPCid:    cp.PieceCID.String(),
+		PieceSize:   uint64(cp.PieceSize.Unpadded().Padded()),
+		CarFileSize: n,
+	}, nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/fatih/color"
+	bapi "github.com/filecoin-project/boost/api"
+	"github.com/filecoin-project/boost/cmd"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/filecoin-project/lotus/lib/tablewriter"
+	"github.com/google/uuid"
+	"github.com/urfave/cli/v2"
+)
+
+var dealsCmd = &cli.Command{
+	Name:  "deals",
+	Usage: "Inspect the deals recorded in the repo",
+	Subcommands: []*cli.Command{
+		dealsListCmd,
+		dealsShowCmd,
+		dealsStatusCmd,
+	},
+}
+
+var dealsListCmd = &cli.Command{
+	Name:   "list",
+	Usage:  "List the deals run proposed",
+	Before: before,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the deals as json",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+
+		ds, err := openRepoDatastore(cctx)
+		if err != nil {
+			return err
+		}
+		defer ds.Close() // nolint:errcheck
+
+		deals, err := listDeals(ctx, ds)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool("json") {
+			if deals == nil {
+				deals = []*dealRecord{}
+			}
+			return cmd.PrintJson(deals)
+		}
+
+		tw := tablewriter.New(
+			tablewriter.Col("UUID"),
+			tablewriter.Col("Created"),
+			tablewriter.Col("Provider"),
+			tablewriter.Col("Stage"),
+			tablewriter.Col("Piece CID"),
+			tablewriter.Col("Piece Size"),
+			tablewriter.Col("Car Size"),
+			tablewriter.NewLineCol("Error"))
+		for _, d := range deals {
+			row := map[string]interface{}{
+				"UUID":       d.UUID,
+				"Created":    d.Created.Format(time.DateTime),
+				"Provider":   d.Provider,
+				"Stage":      d.Stage,
+				"Piece CID":  d.PieceCID,
+				"Piece Size": units.BytesSize(float64(d.PieceSize)),
+				"Car Size":   units.BytesSize(float64(d.CarSize)),
+			}
+			if d.Error != "" {
+				row["Error"] = d.Error
+			}
+			tw.Write(row)
+		}
+		return tw.Flush(cctx.App.Writer)
+	},
+}
+
+var dealsShowCmd = &cli.Command{
+	Name:      "show",
+	Usage:     "Show a deal with its proposal and the stages it went through",
+	ArgsUsage: "<uuid>",
+	Before:    before,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the deal as json",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		afmt := NewAppFmt(cctx.App)
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify the deal uuid")
+		}
+		id, err := uuid.Parse(cctx.Args().First())
+		if err != nil {
+			return fmt.Errorf("deal uuid: %w", err)
+		}
+
+		ds, err := openRepoDatastore(cctx)
+		if err != nil {
+			return err
+		}
+		defer ds.Close() // nolint:errcheck
+
+		d, err := getDeal(ctx, ds, id)
+		if err != nil {
+			return err
+		}
+		if cctx.Bool("json") {
+			return cmd.PrintJson(d)
+		}
+
+		afmt.Printf("UUID:        %s\n", d.UUID)
+		afmt.Printf("Stage:       %s\n", d.Stage)
+		if d.Error != "" {
+			afmt.Printf("Error:       %s\n", d.Error)
+		}
+		afmt.Printf("Provider:    %s\n", d.Provider)
+		afmt.Printf("Wallet:      %s\n", d.Wallet)
+		afmt.Printf("Root:        %s\n", d.Root)
+		afmt.Printf("Piece CID:   %s\n", d.PieceCID)
+		afmt.Printf("Piece size:  %d\n", d.PieceSize)
+		afmt.Printf("Car size:    %d\n", d.CarSize)
+		afmt.Printf("Path:        %s\n", d.Path)
+		afmt.Printf("Created:     %s\n", d.Created.Format(time.DateTime))
+		if d.Response != "" {
+			afmt.Printf("Response:    %s\n", d.Response)
+		}
+
+		if dp := d.Proposal; dp != nil {
+			afmt.Println("\nProposal:")
+			afmt.Printf("  Start epoch:   %d\n", dp.Proposal.StartEpoch)
+			afmt.Printf("  End epoch:     %d\n", dp.Proposal.EndEpoch)
+			afmt.Printf("  Price:         %s per epoch\n", types.FIL(dp.Proposal.StoragePricePerEpoch))
+			afmt.Printf("  Collateral:    %s\n", types.FIL(dp.Proposal.ProviderCollateral))
+			afmt.Printf("  Verified:      %t\n", dp.Proposal.VerifiedDeal)
+			if c, err := dp.Proposal.Cid(); err == nil {
+				afmt.Printf("  Proposal CID:  %s\n", c)
+			}
+		}
+
+		afmt.Println("\nStages:")
+		tw := tablewriter.New(
+			tablewriter.Col("At"),
+			tablewriter.Col("Stage"),
+			tablewriter.NewLineCol("Error"))
+		for _, t := range d.Transitions {
+			row := map[string]interface{}{
+				"At":    t.At.Format(time.DateTime),
+				"Stage": t.Stage,
+			}
+			if t.Error != "" {
+				row["Error"] = t.Error
+			}
+			tw.Write(row)
+		}
+		return tw.Flush(cctx.App.Writer)
+	},
+}
+
+var dealsStatusCmd = &cli.Command{
+	Name:      "status",
+	Usage:     "Follow the deals through boost and the chain",
+	ArgsUsage: "[uuid...]",
+	Before:    before,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "also show proposals the provider rejected or never got",
+		},
+		&cli.StringSliceFlag{
+			Name:  "provider",
+			Usage: "boost node of a provider as <address>@<boost-api-info>, repeat it for each provider of the deals, without it BOOST_API_INFO serves the deals of a single provider",
+		},
+		&cli.DurationFlag{
+			Name:  "stuck-after",
+			Usage: "time without progress after which a deal is reported stuck",
+			Value: defaultStuckAfter,
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the status as json",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		afmt := NewAppFmt(cctx.App)
+
+		ds, err := openRepoDatastore(cctx)
+		if err != nil {
+			return err
+		}
+		defer ds.Close() // nolint:errcheck
+
+		var deals []*dealRecord
+		if cctx.Args().Present() {
+			for _, arg := range cctx.Args().Slice() {
+				id, err := uuid.Parse(arg)
+				if err != nil {
+					return fmt.Errorf("deal uuid %q: %w", arg, err)
+				}
+				d, err := getDeal(ctx, ds, id)
+				if err != nil {
+					return err
+				}
+				deals = append(deals, d)
+			}
+		} else {
+			all, err := listDeals(ctx, ds)
+			if err != nil {
+				return err
+			}
+			for _, d := range all {
+				if cctx.Bool("all") || (d.Stage != dealStageRejected && d.Stage != dealStageFailed) {
+					deals = append(deals, d)
+				}
+			}
+		}
+
+		boost, closer, err := dealsBoost(ctx, cctx, deals)
+		if err != nil {
+			return err
+		}
+		defer closer()
+		chain, chainCloser, err := lcli.GetGatewayAPI(cctx)
+		if err != nil {
+			return fmt.Errorf("cant setup gateway connection: %w", err)
+		}
+		defer chainCloser()
+		head, err := chain.ChainHead(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot get chain head: %w", err)
+		}
+
+		t := &dealTracker{boost: boost, chain: chain, stuckAfter: cctx.Duration("stuck-after")}
+		statuses := []*dealStatus{}
+		for _, d := range deals {
+			s, err := t.status(ctx, head, d)
+			if err != nil {
+				return err
+			}
+			statuses = append(statuses, s)
+		}
+		if cctx.Bool("json") {
+			return cmd.PrintJson(statuses)
+		}
+
+		epoch := func(e abi.ChainEpoch) string {
+			if e < 0 {
+				return ""
+			}
+			return fmt.Sprint(e)
+		}
+		counts := map[string]int{}
+		var stuck int
+		tw := tablewriter.New(
+			tablewriter.Col("UUID"),
+			tablewriter.Col("Provider"),
+			tablewriter.Col("State"),
+			tablewriter.Col("Checkpoint"),
+			tablewriter.Col("Sector"),
+			tablewriter.Col("Deal ID"),
+			tablewriter.Col("Published"),
+			tablewriter.Col("Activated"),
+			tablewriter.NewLineCol("Problem"))
+		for _, s := range statuses {
+			counts[s.State]++
+			state := s.State
+			switch {
+			case s.State == dealStateFailed:
+				state = color.RedString(state)
+			case s.State == dealStateUnknown:
+				state = color.YellowString(state)
+			case s.Stuck:
+				stuck++
+				state = color.YellowString(state + " (stuck)")
+			}
+			row := map[string]interface{}{
+				"UUID":       s.UUID,
+				"Provider":   s.Provider,
+				"State":      state,
+				"Checkpoint": s.Checkpoint,
+				"Published":  epoch(s.PublishEpoch),
+				"Activated":  epoch(s.ActivationEpoch),
+			}
+			if s.ChainDealID != 0 {
+				row["Sector"] = s.SectorID
+				row["Deal ID"] = s.ChainDealID
+			}
+			if s.Problem != "" {
+				row["Problem"] = s.Problem
+			}
+			tw.Write(row)
+		}
+		if err := tw.Flush(cctx.App.Writer); err != nil {
+			return err
+		}
+
+		var summary []string
+		for _, state := range append(dealStates, dealStateExpired, dealStateFailed, dealStateUnknown) {
+			if counts[state] > 0 {
+				summary = append(summary, fmt.Sprintf("%d %s", counts[state], state))
+			}
+		}
+		if stuck > 0 {
+			summary = append(summary, fmt.Sprintf("%d stuck", stuck))
+		}
+		afmt.Printf("\n%d deals at epoch %d: %s\n", len(statuses), head.Height(), strings.Join(summary, ", "))
+		return nil
+	},
+}
+
+// dealsBoost connects to the boost nodes of --provider, or to BOOST_API_INFO
+// for the deals of a single provider.
+func dealsBoost(ctx context.Context, cctx *cli.Context, deals []*dealRecord) (map[string]bapi.Boost, func(), error) {
+	specs := cctx.StringSlice("provider")
+	if len(specs) == 0 {
+		for _, d := range deals {
+			if !slices.Contains(specs, d.Provider) {
+				specs = append(specs, d.Provider)
+			}
+		}
+		if len(specs) != 1 {
+			return map[string]bapi.Boost{}, func() {}, nil
+		}
+	}
+	providers, err := parseProviders(specs, strategyRoundRobin, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nodes := map[string]bapi.Boost{}
+	var closers []func()
+	for _, p := range providers.providers {
+		boost, closer, err := boostAPI(ctx, cctx, p.boostInfo)
+		if err != nil {
+			log.Warnw("cant setup boost connection", "provider", p.addr, "err", err)
+			continue
+		}
+		nodes[p.addr.String()] = boost
+		closers = append(closers, closer)
+	}
+	return nodes, func() {
+		for _, c := range closers {
+			c()
+		}
+	}, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+)
+
+var gcCmd = &cli.Command{
+	Name:   "gc",
+	Usage:  "Report and remove temp files and cars left behind by killed runs",
+	Before: before,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "car-path",
+			Usage: "directory run writes its car files to, if not specified, the one in the repo",
+		},
+		poolFlag,
+		&cli.DurationFlag{
+			Name:  "min-age",
+			Usage: "only consider files last modified longer ago than this, sparing those of a run that just started",
+			Value: 10 * time.Minute,
+		},
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "also consider car files in the car path pledge did not name, which other tools may own",
+		},
+		&cli.BoolFlag{
+			Name:  "really-do-it",
+			Usage: "remove the leftovers instead of only reporting them",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		afmt := NewAppFmt(cctx.App)
+
+		dir, err := homedir.Expand(cctx.String("repo"))
+		if err != nil {
+			return fmt.Errorf("repo: %w", err)
+		}
+		carPath := path.Join(dir, "temp")
+		if cctx.IsSet("car-path") {
+			carPath = cctx.String("car-path")
+		}
+
+		ds, err := openDatastore(dir)
+		if err != nil {
+			return fmt.Errorf("opening datastore, is pledge running on this repo: %w", err)
+		}
+		defer ds.Close() // nolint:errcheck
+
+		referenced, err := dealtCars(ctx, ds)
+		if err != nil {
+			return err
+		}
+
+		stale, records, live, err := inflightFiles(dir)
+		if err != nil {
+			return err
+		}
+
+		var leftovers []leftover
+		listed := map[string]bool{}
+		add := func(p, reason string, fi fs.FileInfo) {
+			listed[p] = true
+			leftovers = append(leftovers, leftover{path: p, reason: reason, size: fi.Size()})
+		}
+
+		for _, f := range stale {
+			fi, err := os.Stat(f)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			add(f, "in flight in a killed run", fi)
+		}
+
+		minAge := cctx.Duration("min-age")
+		candidate := func(p string, fi fs.FileInfo) bool {
+			return fi.Mode().IsRegular() && !listed[p] && !live[p] && time.Since(fi.ModTime()) >= minAge
+		}
+
+		seen := map[string]bool{}
+		for _, d := range []string{dir, path.Join(dir, "temp"), carPath, poolPath(cctx, dir)} {
+			d = absPath(d)
+			if seen[d] {
+				continue
+			}
+			seen[d] = true
+
+			entries, err := os.ReadDir(d)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				p := path.Join(d, e.Name())
+				fi, err := e.Info()
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if !candidate(p, fi) {
+					continue
+				}
+
+				switch {
+				case isTempName(e.Name()):
+					add(p, "temp file", fi)
+				case d == absPath(carPath) && strings.HasSuffix(e.Name(), ".car"):
+					if !isPieceCarName(e.Name()) && !cctx.Bool("all") {
+						continue
+					}
+					// pool pieces are referenced by their manifest entry
+					if referenced[p] || fileExists(manifestPath(p)) {
+						continue
+					}
+					add(p, "car no deal references", fi)
+					if fi, err := os.Stat(sidecarIndexPath(p)); err == nil && candidate(sidecarIndexPath(p), fi) {
+						add(sidecarIndexPath(p), "index of a car no deal references", fi)
+					}
+				}
+			}
+		}
+
+		sort.Slice(leftovers, func(i, j int) bool {
+			return leftovers[i].path < leftovers[j].path
+		})
+		var total int64
+		for _, l := range leftovers {
+			total += l.size
+			afmt.Printf("%-10s %s (%s)\n", units.BytesSize(float64(l.size)), l.path, l.reason)
+		}
+		afmt.Printf("%d leftovers, %s\n", len(leftovers), units.BytesSize(float64(total)))
+
+		if !cctx.Bool("really-do-it") {
+			if len(leftovers) > 0 {
+				afmt.Println("run with --really-do-it to remove them")
+			}
+			return nil
+		}
+
+		for _, l := range leftovers {
+			if err := os.Remove(l.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		for _, r := range records {
+			if err := os.Remove(r); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		log.Infow("removed leftovers", "count", len(leftovers), "size", total)
+		return nil
+	},
+}
+
+type leftover struct {
+	path   string
+	reason string
+	size   int64
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+)
+
+var generateCmd = &cli.Command{
+	Name:   "generate",
+	Usage:  "Pre-build pieces into the pool for run --from-pool",
+	Before: before,
+	Flags: append([]cli.Flag{
+		&cli.IntFlag{
+			Name:  "count",
+			Usage: "number of pieces to generate",
+			Value: 1,
+		},
+		poolFlag,
+	}, append(pieceFlags, spaceFlags...)...),
+	Action: func(cctx *cli.Context) error {
+		if cctx.Int("count") < 1 {
+			return fmt.Errorf("count must be at least 1")
+		}
+
+		gen, err := newPieceGenerator(cctx)
+		if err != nil {
+			return err
+		}
+
+		dir, err := homedir.Expand(cctx.String("repo"))
+		if err != nil {
+			return fmt.Errorf("repo: %w", err)
+		}
+		pool := poolPath(cctx, dir)
+		if err := os.MkdirAll(pool, 0755); err != nil {
+			return err
+		}
+		space, err := newSpaceGuard(cctx, dir, pool)
+		if err != nil {
+			return err
+		}
+		if err := tempFiles.open(dir); err != nil {
+			return err
+		}
+		defer tempFiles.close()
+
+		var total int64
+		for i := 0; i < cctx.Int("count"); i++ {
+			p, err := gen.next(cctx.Context, pool, space)
+			if err != nil {
+				if cctx.Context.Err() != nil {
+					// abandoned, finished pieces stay in the pool
+					tempFiles.cleanup()
+					return fmt.Errorf("interrupted after %d pieces: %w", i, cctx.Context.Err())
+				}
+				return err
+			}
+			if err := addToPool(pool, p); err != nil {
+				return fmt.Errorf("adding %s to the pool: %w", p.Root, err)
+			}
+			tempFiles.untrack(p.Path, sidecarIndexPath(p.Path))
+			total += p.Size
+			log.Infow("piece added to pool", "pool", pool, "root", p.Root, "piece", p.PieceCID, "count", i+1)
+		}
+
+		log.Infow("total generated", "value", total, "count", cctx.Int("count"), "seed", gen.seed, "size-distribution", gen.sizes.String())
+		return nil
+	},
+}
@@ -4,19 +4,19 @@ import (
 	"context"
 	"fmt"
 
+	bapi "github.com/filecoin-project/boost/api"
 	"github.com/filecoin-project/boost/api/client"
 
 	"github.com/filecoin-project/boost/node/repo"
 
-	"math/rand"
 	"os"
 	"path"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/docker/go-units"
 	"github.com/filecoin-project/boost/cli/node"
-	"github.com/filecoin-project/boost/cmd"
 	boostTypes "github.com/filecoin-project/boost/storagemarket/types"
 	"github.com/filecoin-project/go-address"
 	cborutil "github.com/filecoin-project/go-cbor-util"
@@ -26,12 +26,12 @@ import (
 	"github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/chain/types"
 	lcli "github.com/filecoin-project/lotus/cli"
+	cliutil "github.com/filecoin-project/lotus/cli/util"
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
-	"github.com/ipfs/go-cidutil/cidenc"
+	"github.com/ipfs/go-datastore"
 	inet "github.com/libp2p/go-libp2p/core/network"
 	"github.com/mitchellh/go-homedir"
-	"github.com/multiformats/go-multibase"
 	"github.com/urfave/cli/v2"
 )
 
@@ -39,29 +39,24 @@ var runCmd = &cli.Command{
 	Name:   "run",
 	Usage:  "Run pledge",
 	Before: before,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "car-path",
 			Usage: "specify the path to the car file, if not specified, it will save the car file to the repo",
 		},
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:     "provider",
-			Usage:    "storage provider on-chain address",
+			Usage:    "storage provider on-chain address as <address>[=<weight>][@<boost-api-info>], repeat it with the boost api of each to pledge to several",
 			Required: true,
 		},
 		&cli.StringFlag{
-			Name:  "min-size",
-			Usage: "min size of the car file",
-			Value: "1GiB",
-		},
-		&cli.StringFlag{
-			Name:  "max-size",
-			Usage: "max size of the car file",
-			Value: "31GiB",
+			Name:  "provider-strategy",
+			Usage: fmt.Sprintf("how pieces are distributed among the providers, one of: %s", strings.Join(providerStrategies, ", ")),
+			Value: strategyRoundRobin,
 		},
 		&cli.StringFlag{
 			Name:  "max-pledge",
-			Usage: "max size of the pledge",
+			Usage: "max size of the pledge to each provider, if not specified, each provider gets one deal",
 		},
 		&cli.BoolFlag{
 			Name:  "verified",
@@ -100,24 +95,73 @@ var runCmd = &cli.Command{
 			Name:  "start-epoch",
 			Usage: "start epoch by when the deal should be proved by provider on-chain",
 		},
-	},
+		&cli.BoolFlag{
+			Name:  "from-pool",
+			Usage: "take pieces from the pool filled by generate instead of generating them",
+		},
+		poolFlag,
+		&cli.IntFlag{
+			Name:  "generate-concurrency",
+			Usage: "number of pieces built at once",
+			Value: 1,
+		},
+		&cli.IntFlag{
+			Name:  "commp-concurrency",
+			Usage: "number of pieces whose piece commitment is calculated at once",
+			Value: 1,
+		},
+		&cli.IntFlag{
+			Name:  "deal-concurrency",
+			Usage: "number of deals proposed and imported at once",
+			Value: 1,
+		},
+		&cli.StringFlag{
+			Name:  "from-dir",
+			Usage: "make deals from the car files in this directory, each of them once, instead of generating pieces",
+		},
+		&cli.StringFlag{
+			Name:  "wait-for",
+			Usage: fmt.Sprintf("exit only once every deal made is at least this far, one of: %s", strings.Join(dealStates[1:], ", ")),
+		},
+		&cli.DurationFlag{
+			Name:  "wait-timeout",
+			Usage: "how long to wait for the deals with --wait-for",
+			Value: 72 * time.Hour,
+		},
+		&cli.DurationFlag{
+			Name:  "wait-interval",
+			Usage: "how often the deals are checked with --wait-for",
+			Value: time.Minute,
+		},
+	}, append(append(pieceFlags, spaceFlags...), retryFlags...)...),
 
 	Action: runAction,
 }
 
 func runAction(cctx *cli.Context) error {
-	ctx := lcli.ReqContext(cctx)
+	ctx := cctx.Context
 
-	carMinSize, err := units.RAMInBytes(cctx.String("min-size"))
-	if err != nil {
-		return fmt.Errorf("min size: %w", err)
+	if cctx.Bool("from-pool") && cctx.IsSet("from-dir") {
+		return fmt.Errorf("--from-pool and --from-dir cannot be used together")
 	}
-	carMaxSize, err := units.RAMInBytes(cctx.String("max-size"))
-	if err != nil {
-		return fmt.Errorf("max size: %w", err)
+	for _, name := range []string{"generate-concurrency", "commp-concurrency", "deal-concurrency"} {
+		if cctx.Int(name) < 1 {
+			return fmt.Errorf("%s must be at least 1", name)
+		}
+	}
+
+	waitFor := cctx.String("wait-for")
+	if cctx.IsSet("wait-for") && (waitFor == dealStatePending || !slices.Contains(dealStates, waitFor)) {
+		return fmt.Errorf("unknown deal state %q to wait for, must be one of: %s", waitFor, strings.Join(dealStates[1:], ", "))
 	}
-	if carMinSize > carMaxSize {
-		return fmt.Errorf("min size is greater than max size")
+
+	var gen *pieceGenerator
+	var err error
+	if !cctx.Bool("from-pool") && !cctx.IsSet("from-dir") {
+		gen, err = newPieceGenerator(cctx)
+		if err != nil {
+			return err
+		}
 	}
 
 	var maxPledge int64
@@ -127,6 +171,14 @@ func runAction(cctx *cli.Context) error {
 			return fmt.Errorf("max pledge: %w", err)
 		}
 	}
+	retry, err := newBackoff(cctx)
+	if err != nil {
+		return err
+	}
+	providers, err := parseProviders(cctx.StringSlice("provider"), cctx.String("provider-strategy"), maxPledge)
+	if err != nil {
+		return err
+	}
 	dir, err := homedir.Expand(cctx.String("repo"))
 	if err != nil {
 		return fmt.Errorf("repo: %w", err)
@@ -137,12 +189,36 @@ func runAction(cctx *cli.Context) error {
 		return err
 	}
 
+	ds, err := openDatastore(dir)
+	if err != nil {
+		return fmt.Errorf("opening datastore: %w", err)
+	}
+	defer ds.Close() // nolint:errcheck
+
+	swept, err := sweepTempFiles(dir)
+	if err != nil {
+		return fmt.Errorf("sweeping temp files: %w", err)
+	}
+	if len(swept) > 0 {
+		log.Infow("removed temp files of an earlier run", "files", swept)
+	}
+	if err := tempFiles.open(dir); err != nil {
+		return err
+	}
+	defer tempFiles.close()
+
 	nodeAPI, closer, err := lcli.GetGatewayAPI(cctx)
 	if err != nil {
 		return fmt.Errorf("cant setup gateway connection: %w", err)
 	}
 	defer closer()
 
+	boostCloser, err := providers.connectBoost(ctx, cctx)
+	if err != nil {
+		return err
+	}
+	defer boostCloser()
+
 	walletAddr, err := n.GetProvidedOrDefaultWallet(ctx, cctx.String("wallet"))
 	if err != nil {
 		return err
@@ -166,149 +242,176 @@ func runAction(cctx *cli.Context) error {
 	} else {
 		carPath = path.Join(dir, "temp")
 	}
-	var totalPledge int64
 
-	if maxPledge > 0 {
-		for totalPledge < maxPledge {
-			// run pledge
-			size := carMinSize + rand.Int63n(carMaxSize-carMinSize+1)
-			if err := runPledge(ctx, cctx, nodeAPI, n, walletAddr, dir, carPath, size); err != nil {
-				return err
+	space, err := newSpaceGuard(cctx, dir, carPath)
+	if err != nil {
+		return err
+	}
+
+	r := &pledgeRun{
+		cctx:      cctx,
+		api:       nodeAPI,
+		node:      n,
+		wallet:    walletAddr,
+		ds:        ds,
+		providers: providers,
+		space:     space,
+		carPath:   carPath,
+		retry:     retry,
+		gen:       gen,
+		// generated pieces are removed with the other temp files
+		giveBack: func(p *piece) {},
+	}
+
+	pool := poolPath(cctx, dir)
+	if cctx.IsSet("from-dir") {
+		r.cars, err = openCarDir(cctx.String("from-dir"), ds, cctx.Int("commp-workers"))
+		if err != nil {
+			return err
+		}
+		r.take = func(ctx context.Context) (*piece, error) {
+			// the cars are imported where they are, only the datastore grows
+			release, err := space.admit(ctx, nil)
+			if err != nil {
+				return nil, err
 			}
-			totalPledge += size
+			release()
+			return r.cars.next(ctx)
 		}
-	} else {
-		size := carMinSize + rand.Int63n(carMaxSize-carMinSize+1)
-		if err := runPledge(ctx, cctx, nodeAPI, n, walletAddr, dir, carPath, size); err != nil {
-			return err
+	} else if gen == nil {
+		r.take = func(ctx context.Context) (*piece, error) {
+			return takeFromPool(ctx, pool, carPath, space)
+		}
+		r.giveBack = func(p *piece) {
+			if err := returnToPool(pool, p); err != nil {
+				log.Errorw("failed to return piece to the pool", "root", p.Root, "path", p.Path, "err", err)
+			}
 		}
-		totalPledge += size
 	}
-	log.Infow("total pledge", "value", totalPledge)
-	return nil
-}
 
-func runPledge(ctx context.Context, cctx *cli.Context, api api.Gateway, n *node.Node, walletAddr address.Address, dir, carPath string, size int64) error {
-	start := time.Now()
+	err = r.run(ctx, cctx.Int("generate-concurrency"), cctx.Int("commp-concurrency"), cctx.Int("deal-concurrency"))
 
-	log.Infof("create random file, size: %d", size)
-	rf, err := CreateRandomFile(dir, size)
-	if err != nil {
-		return err
+	providers.logTotals()
+	totalPledge := r.total.Load()
+	if r.cars != nil {
+		log.Infow("total pledge", "value", totalPledge, "dir", cctx.String("from-dir"))
+	} else if gen == nil {
+		log.Infow("total pledge", "value", totalPledge, "pool", pool)
+	} else {
+		log.Infow("total pledge", "value", totalPledge, "seed", gen.seed, "size-distribution", gen.sizes.String())
+	}
+	if ctx.Err() != nil {
+		tempFiles.cleanup()
+		return fmt.Errorf("interrupted: %w", ctx.Err())
 	}
-	log.Debugw("create random file", "path", rf, "size", size, "duration", time.Since(start))
-
-	defer func() {
-		log.Debugw("remove random file", "path", rf)
-		if err := os.Remove(rf); err != nil {
-			log.Errorf("remove file %s error: %s", rf, err)
-		}
-	}()
-
-	log.Infof("create car file from %s", rf)
-	start1 := time.Now()
-	root, cn, err := CreateDenseCARv2(dir, rf)
 	if err != nil {
+		// pieces no deal was made for are of no use anymore
+		tempFiles.cleanup()
 		return err
 	}
 
-	encoder := cidenc.Encoder{Base: multibase.MustNewEncoder(multibase.Base32)}
-	rn := encoder.Encode(root)
-
-	np := path.Join(carPath, rn+".car")
-
-	rootCid, err := cid.Parse(rn)
-	if err != nil {
-		return fmt.Errorf("failed to parse root cid: %w", err)
+	if waitFor == "" || len(r.deals) == 0 {
+		return nil
 	}
-
-	err = MoveFile(cn, np)
-	if err != nil {
-		return err
+	// every deal is recorded, let deals status and gc open the repo while
+	// the deals are waited for
+	if err := ds.Close(); err != nil {
+		return fmt.Errorf("closing datastore: %w", err)
 	}
-	log.Infow("create car file", "path", np, "cid", rn, "duration", time.Since(start1))
+	t := &dealTracker{boost: providers.boostNodes(), chain: nodeAPI, stuckAfter: defaultStuckAfter}
+	log.Infow("waiting for deals", "state", waitFor, "deals", len(r.deals), "timeout", cctx.Duration("wait-timeout"))
+	if err := t.wait(ctx, r.deals, waitFor, cctx.Duration("wait-timeout"), cctx.Duration("wait-interval")); err != nil {
+		return fmt.Errorf("waiting for deals to be %s: %w", waitFor, err)
+	}
+	log.Infow("every deal is there", "state", waitFor, "deals", len(r.deals))
+	return nil
+}
 
-	cp, err := commP(np)
+// runPledge proposes the deal d and returns once the provider accepted it.
+func runPledge(ctx context.Context, cctx *cli.Context, api api.Gateway, n *node.Node, walletAddr address.Address, prov *provider, ds datastore.Datastore, d *dealRecord) error {
+	rootCid, err := cid.Parse(d.Root)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to parse root cid: %w", err)
 	}
-
-	pieceCid, err := cid.Parse(cp.CommPCid)
+	pieceCid, err := cid.Parse(d.PieceCID)
 	if err != nil {
 		return fmt.Errorf("failed to parse piece cid: %w", err)
 	}
 
-	maddr, err := address.NewFromString(cctx.String("provider"))
+	maddr := prov.addr
+	addrInfo, err := prov.lookup(ctx, api, n)
 	if err != nil {
 		return err
 	}
-
-	addrInfo, err := cmd.GetAddrInfo(ctx, api, maddr)
-	if err != nil {
+	storagePrice := abi.NewTokenAmount(cctx.Int64("storage-price"))
+	if err := prov.checkAsk(abi.PaddedPieceSize(d.PieceSize), storagePrice, cctx.Bool("verified")); err != nil {
 		return err
 	}
-	log.Debugw("storage provider", "id", addrInfo.ID, "multiaddrs", addrInfo.Addrs, "addr", maddr)
-
-	if err := n.Host.Connect(ctx, *addrInfo); err != nil {
-		return fmt.Errorf("failed to connect to peer %s: %w", addrInfo.ID, err)
-	}
-	x, err := n.Host.Peerstore().FirstSupportedProtocol(addrInfo.ID, DealProtocolv120)
-	if err != nil {
-		return fmt.Errorf("getting protocols for peer %s: %w", addrInfo.ID, err)
-	}
 
-	if len(x) == 0 {
-		return fmt.Errorf("boost client cannot make a deal with storage provider %s because it does not support protocol version 1.2.0", maddr)
-	}
-	dealUuid := uuid.New()
 	transfer := boostTypes.Transfer{}
 
-	var providerCollateral abi.TokenAmount
+	// the proposal is signed once, retries send the very same one
+	if d.Proposal == nil {
+		var providerCollateral abi.TokenAmount
 
-	bounds, err := api.StateDealProviderCollateralBounds(ctx, abi.PaddedPieceSize(cp.PieceSize), false, types.EmptyTSK)
-	if err != nil {
-		return fmt.Errorf("node error getting collateral bounds: %w", err)
-	}
-	providerCollateral = big.Div(big.Mul(bounds.Min, big.NewInt(6)), big.NewInt(5)) // add 20%
+		bounds, err := api.StateDealProviderCollateralBounds(ctx, abi.PaddedPieceSize(d.PieceSize), false, types.EmptyTSK)
+		if err != nil {
+			return transient(fmt.Errorf("node error getting collateral bounds: %w", err))
+		}
+		providerCollateral = big.Div(big.Mul(bounds.Min, big.NewInt(6)), big.NewInt(5)) // add 20%
 
-	tipset, err := api.ChainHead(ctx)
-	if err != nil {
-		return fmt.Errorf("cannot get chain head: %w", err)
-	}
+		tipset, err := api.ChainHead(ctx)
+		if err != nil {
+			return transient(fmt.Errorf("cannot get chain head: %w", err))
+		}
 
-	head := tipset.Height()
-	log.Debugw("current block height", "number", head)
+		head := tipset.Height()
+		log.Debugw("current block height", "number", head)
 
-	var startEpoch abi.ChainEpoch
+		var startEpoch abi.ChainEpoch
 
-	if cctx.IsSet("start-epoch-head-offset") {
-		startEpoch = head + abi.ChainEpoch(cctx.Int("start-epoch-head-offset"))
-	} else if cctx.IsSet("start-epoch") {
-		startEpoch = abi.ChainEpoch(cctx.Int("start-epoch"))
-	} else {
-		// default
-		startEpoch = head + abi.ChainEpoch(5760) // head + 2 days
-	}
+		if cctx.IsSet("start-epoch-head-offset") {
+			startEpoch = head + abi.ChainEpoch(cctx.Int("start-epoch-head-offset"))
+		} else if cctx.IsSet("start-epoch") {
+			startEpoch = abi.ChainEpoch(cctx.Int("start-epoch"))
+		} else {
+			// default
+			startEpoch = head + abi.ChainEpoch(5760) // head + 2 days
+		}
 
-	dp, err := dealProposal(ctx, n, walletAddr, rootCid, abi.PaddedPieceSize(cp.PieceSize), pieceCid, maddr, startEpoch, cctx.Int("duration"), cctx.Bool("verified"), providerCollateral, abi.NewTokenAmount(cctx.Int64("storage-price")))
-	if err != nil {
-		return fmt.Errorf("failed to create a deal proposal: %w", err)
+		// signing uses the local wallet, its failures are not transient
+		d.Proposal, err = dealProposal(ctx, n, walletAddr, rootCid, abi.PaddedPieceSize(d.PieceSize), pieceCid, maddr, startEpoch, cctx.Int("duration"), cctx.Bool("verified"), providerCollateral, storagePrice)
+		if err != nil {
+			return fmt.Errorf("failed to create a deal proposal: %w", err)
+		}
 	}
 
 	dealParams := boostTypes.DealParams{
-		DealUUID:           dealUuid,
-		ClientDealProposal: *dp,
+		DealUUID:           d.UUID,
+		ClientDealProposal: *d.Proposal,
 		DealDataRoot:       rootCid,
 		IsOffline:          true,
 		Transfer:           transfer,
 		RemoveUnsealedCopy: cctx.Bool("remove-unsealed-copy"),
 		SkipIPNIAnnounce:   cctx.Bool("skip-ipni-announce"),
 	}
-	log.Debugw("about to submit deal proposal", "uuid", dealUuid.String())
+	log.Debugw("about to submit deal proposal", "uuid", d.UUID.String())
+
+	// once the proposal is sent the deal is seen through, shutting down only
+	// abandons deals the provider has not heard of
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cctx.Duration("proposal-timeout"))
+	defer cancel()
+
+	if err := d.advance(ctx, ds, dealStageProposed, nil); err != nil {
+		return err
+	}
 
 	s, err := n.Host.NewStream(ctx, addrInfo.ID, DealProtocolv120)
 	if err != nil {
-		return fmt.Errorf("failed to open stream to peer %s: %w", addrInfo.ID, err)
+		return transient(fmt.Errorf("failed to open stream to peer %s: %w", addrInfo.ID, err))
 	}
 	defer func(s inet.Stream) {
 		err := s.Close()
@@ -319,14 +422,15 @@ func runPledge(ctx context.Context, cctx *cli.Context, api api.Gateway, n *node.
 
 	var resp boostTypes.DealResponse
 	if err := doRpc(ctx, s, &dealParams, &resp); err != nil {
-		return fmt.Errorf("send proposal rpc: %w", err)
+		return transient(fmt.Errorf("send proposal rpc: %w", err))
 	}
+	d.Response = resp.Message
 
 	if !resp.Accepted {
 		return fmt.Errorf("deal proposal rejected: %s", resp.Message)
 	}
 
-	return importData(cctx, dealUuid.String(), np)
+	return nil
 }
 
 func dealProposal(ctx context.Context, n *node.Node, clientAddr address.Address, rootCid cid.Cid, pieceSize abi.PaddedPieceSize, pieceCid cid.Cid, minerAddr address.Address, startEpoch abi.ChainEpoch, duration int, verified bool, providerCollateral abi.TokenAmount, storagePrice abi.TokenAmount) (*market.ClientDealProposal, error) {
@@ -367,7 +471,7 @@ func dealProposal(ctx context.Context, n *node.Node, clientAddr address.Address,
 	}, nil
 }
 
-func importData(cctx *cli.Context, id string, filePath string) error {
+func importData(ctx context.Context, napi bapi.Boost, id string, filePath string) error {
 	_, err := os.Stat(filePath)
 	if err != nil {
 		return fmt.Errorf("opening file %s: %w", filePath, err)
@@ -382,20 +486,11 @@ func importData(cctx *cli.Context, id string, filePath string) error {
 		}
 		proposalCid = &propCid
 	}
-	addr, headers, err := lcli.GetRawAPI(cctx, repo.Boost, "v0")
-	if err != nil {
-		return err
-	}
-	napi, closer, err := client.NewBoostRPCV0(cctx.Context, addr, headers)
-	if err != nil {
-		return err
-	}
-	defer closer()
 
 	if proposalCid != nil {
 
 		// Look up the deal in the boost database
-		deal, err := napi.BoostDealBySignedProposalCid(cctx.Context, *proposalCid)
+		deal, err := napi.BoostDealBySignedProposalCid(ctx, *proposalCid)
 		if err != nil {
 			// If the error is anything other than a Not Found error,
 			// return the error
@@ -411,7 +506,7 @@ func importData(cctx *cli.Context, id string, filePath string) error {
 	}
 
 	// Deal proposal by deal uuid (v1.2.0 deal)
-	rej, err := napi.BoostOfflineDealWithData(cctx.Context, dealUuid, filePath, true)
+	rej, err := napi.BoostOfflineDealWithData(ctx, dealUuid, filePath, true)
 	if err != nil {
 		return fmt.Errorf("failed to execute offline deal: %w", err)
 	}
@@ -421,3 +516,32 @@ func importData(cctx *cli.Context, id string, filePath string) error {
 	log.Infof("Offline deal import for v1.2.0 deal %s scheduled for execution", dealUuid)
 	return nil
 }
+
+// boostDeal gets a deal from boost, or nil when boost does not know it.
+func boostDeal(ctx context.Context, boost bapi.Boost, id uuid.UUID) (*boostTypes.ProviderDealState, error) {
+	bd, err := boost.BoostDeal(ctx, id)
+	// errors lose their type over RPC, only the message of
+	// storagemarket.ErrDealNotFound is left
+	if err != nil && strings.HasSuffix(err.Error(), "deal not found") {
+		return nil, nil
+	}
+	return bd, err
+}
+
+// boostAPI connects to the boost node of info, or of BOOST_API_INFO when info
+// is empty.
+func boostAPI(ctx context.Context, cctx *cli.Context, info string) (bapi.Boost, func(), error) {
+	if info == "" {
+		addr, headers, err := lcli.GetRawAPI(cctx, repo.Boost, "v0")
+		if err != nil {
+			return nil, nil, err
+		}
+		return client.NewBoostRPCV0(ctx, addr, headers)
+	}
+	ainfo := cliutil.ParseApiInfo(info)
+	addr, err := ainfo.DialArgs("v0")
+	if err != nil {
+		return nil, nil, fmt.Errorf("boost api info: %w", err)
+	}
+	return client.NewBoostRPCV0(ctx, addr, ainfo.AuthHeader())
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs"
+	"github.com/ipfs/go-cid"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/multiformats/go-multihash"
+	"github.com/urfave/cli/v2"
+)
+
+var verifyCarCmd = &cli.Command{
+	Name:      "verify-car",
+	Usage:     "Check the integrity and piece commitment of a car file",
+	ArgsUsage: "<file>",
+	Before:    before,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "root",
+			Usage: "expected root cid of the car",
+		},
+		&cli.StringFlag{
+			Name:  "piece-cid",
+			Usage: "expected piece cid of the car",
+		},
+		&cli.Uint64Flag{
+			Name:  "piece-size",
+			Usage: "expected padded piece size of the car",
+		},
+		&cli.IntFlag{
+			Name:  "commp-workers",
+			Usage: "number of goroutines hashing the piece commitment in parallel",
+			Value: runtime.NumCPU(),
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		afmt := NewAppFmt(cctx.App)
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify the car file")
+		}
+		file := cctx.Args().First()
+
+		var failed int
+		check := func(name string, err error) {
+			if err != nil {
+				failed++
+				afmt.Printf("%-8s FAIL: %s\n", name, err)
+				return
+			}
+			afmt.Printf("%-8s ok\n", name)
+		}
+
+		r, err := car.OpenReader(file)
+		if err != nil {
+			return err
+		}
+		roots, err := r.Roots()
+		if err != nil {
+			_ = r.Close()
+			return fmt.Errorf("reading header: %w", err)
+		}
+		// rehashes every block against its cid
+		stats, inspectErr := r.Inspect(true)
+		_ = r.Close()
+		afmt.Printf("Version: %d\n", r.Version)
+
+		var root cid.Cid
+		check("header", func() error {
+			if len(roots) != 1 {
+				return fmt.Errorf("car has %d roots, expected 1", len(roots))
+			}
+			root = roots[0]
+			afmt.Printf("Root:    %s\n", root)
+			if inspectErr == nil && !stats.RootsPresent && root.Prefix().MhType != multihash.IDENTITY {
+				return fmt.Errorf("root block %s is not in the car", root)
+			}
+			if cctx.IsSet("root") {
+				expected, err := cid.Parse(cctx.String("root"))
+				if err != nil {
+					return fmt.Errorf("expected root: %w", err)
+				}
+				if !expected.Equals(root) {
+					return fmt.Errorf("root is %s, expected %s", root, expected)
+				}
+			}
+			return nil
+		}())
+
+		if inspectErr == nil {
+			afmt.Printf("Blocks:  %d\n", stats.BlockCount)
+		}
+		check("blocks", inspectErr)
+
+		if root.Defined() {
+			walked, err := walkUnixfsDAG(ctx, file, root)
+			if walked != nil {
+				afmt.Printf("Nodes:   %d, %d files, %d directories, %d HAMT shards, %d data bytes\n",
+					walked.nodes, walked.files, walked.dirs, walked.shards, walked.dataBytes)
+				if stored := walked.nodes - walked.inlined; err == nil && inspectErr == nil && stored != stats.BlockCount {
+					afmt.Printf("warning: %d blocks are not reachable from the root\n", stats.BlockCount-stored)
+				}
+			}
+			check("dag", err)
+		}
+
+		cp, err := commP(file, cctx.Int("commp-workers"))
+		if err != nil {
+			return err
+		}
+		afmt.Printf("Piece CID:  %s\n", cp.CommPCid)
+		afmt.Printf("Piece size: %d\n", cp.PieceSize)
+		check("commp", func() error {
+			if cctx.IsSet("piece-cid") {
+				expected, err := cid.Parse(cctx.String("piece-cid"))
+				if err != nil {
+					return fmt.Errorf("expected piece cid: %w", err)
+				}
+				actual, err := cid.Parse(cp.CommPCid)
+				if err != nil {
+					return err
+				}
+				if !expected.Equals(actual) {
+					return fmt.Errorf("piece cid is %s, expected %s", actual, expected)
+				}
+			}
+			if cctx.IsSet("piece-size") && cctx.Uint64("piece-size") != cp.PieceSize {
+				return fmt.Errorf("piece size is %d, expected %d", cp.PieceSize, cctx.Uint64("piece-size"))
+			}
+			return nil
+		}())
+
+		if failed > 0 {
+			return fmt.Errorf("%d checks failed", failed)
+		}
+		return nil
+	},
+}
+
+type dagWalk struct {
+	nodes     uint64
+	inlined   uint64
+	files     uint64
+	dirs      uint64
+	shards    uint64
+	dataBytes uint64
+}
+
+// walkUnixfsDAG checks every node reachable from root decodes as UnixFS with
+// the sizes of its children.
+func walkUnixfsDAG(ctx context.Context, file string, root cid.Cid) (*dagWalk, error) {
+	bs, err := blockstore.OpenReadOnly(file, blockstore.UseWholeCIDs(true))
+	if err != nil {
+		return nil, err
+	}
+	defer bs.Close() // nolint:errcheck
+
+	dagSvc := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	var w dagWalk
+	// the file size each node is expected to have by its parent
+	expected := map[cid.Cid]uint64{}
+	// the entries of every directory and the file size of every other node
+	entries := map[cid.Cid][]cid.Cid{}
+	sizes := map[cid.Cid]uint64{}
+	seen := cid.NewSet()
+	stack := []cid.Cid{root}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !seen.Visit(c) {
+			continue
+		}
+
+		nd, err := dagSvc.Get(ctx, c)
+		if err != nil {
+			return &w, fmt.Errorf("getting %s: %w", c, err)
+		}
+		w.nodes++
+		if c.Prefix().MhType == multihash.IDENTITY {
+			w.inlined++
+		}
+
+		size, dir, err := visitUnixfsNode(nd, &w, expected)
+		if err != nil {
+			return &w, fmt.Errorf("node %s: %w", c, err)
+		}
+		if want, ok := expected[c]; ok && want != size {
+			return &w, fmt.Errorf("node %s has %d bytes, its parent expects %d", c, size, want)
+		}
+
+		for _, l := range nd.Links() {
+			stack = append(stack, l.Cid)
+			if dir {
+				entries[c] = append(entries[c], l.Cid)
+			}
+		}
+		if !dir {
+			sizes[c] = size
+		}
+	}
+
+	// the files below every directory, counted once per directory
+	type count struct{ files, bytes uint64 }
+	counts := map[cid.Cid]count{}
+	var countFiles func(c cid.Cid) count
+	countFiles = func(c cid.Cid) count {
+		if size, ok := sizes[c]; ok {
+			return count{files: 1, bytes: size}
+		}
+		if n, ok := counts[c]; ok {
+			return n
+		}
+		var n count
+		for _, e := range entries[c] {
+			en := countFiles(e)
+			n.files += en.files
+			n.bytes += en.bytes
+		}
+		counts[c] = n
+		return n
+	}
+	n := countFiles(root)
+	w.files, w.dataBytes = n.files, n.bytes
+	return &w, nil
+}
+
+// visitUnixfsNode validates a single node and returns the file size it holds,
+// or whether it is a directory or HAMT shard.
+func visitUnixfsNode(nd ipldformat.Node, w *dagWalk, expected map[cid.Cid]uint64) (uint64, bool, error) {
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		return uint64(len(nd.RawData())), false, nil
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.ExtractFSNode(nd)
+		if err != nil {
+			return 0, false, err
+		}
+
+		switch fsn.Type() {
+		case unixfs.TDirectory:
+			w.dirs++
+			return 0, true, nil
+		case unixfs.THAMTShard:
+			w.shards++
+			return 0, true, nil
+		case unixfs.TFile, unixfs.TRaw:
+			if len(nd.Links()) != fsn.NumChildren() {
+				return 0, false, fmt.Errorf("%d links but %d block sizes", len(nd.Links()), fsn.NumChildren())
+			}
+			total := uint64(len(fsn.Data()))
+			for i, l := range nd.Links() {
+				expected[l.Cid] = fsn.BlockSize(i)
+				total += fsn.BlockSize(i)
+			}
+			if total != fsn.FileSize() {
+				return 0, false, fmt.Errorf("file size is %d but data and block sizes add up to %d", fsn.FileSize(), total)
+			}
+			return fsn.FileSize(), false, nil
+		default:
+			return 0, false, fmt.Errorf("unexpected unixfs node type %s", fsn.Type())
+		}
+	default:
+		return 0, false, fmt.Errorf("unexpected node type %T", nd)
+	}
+}
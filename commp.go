@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"math/bits"
+
+	"github.com/filecoin-project/go-commp-utils/zerocomm"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/storage/sealer/fr32"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-cidutil/cidenc"
+	"github.com/multiformats/go-multibase"
+)
+
+// commPSegmentSize is the padded size of the subtrees commPWriter hashes in
+// parallel. Every worker holds one segment, padded and unpadded.
+const commPSegmentSize = abi.PaddedPieceSize(16 << 20)
+
+type commPBuf struct {
+	unpadded []byte
+	padded   []byte
+}
+
+// commPWriter computes the piece commitment of the data written to it over
+// segments hashed in parallel.
+type commPWriter struct {
+	len     int64
+	cur     *commPBuf
+	fill    int
+	roots   []chan [32]byte
+	free    chan *commPBuf
+	workers int
+}
+
+func newCommPWriter(workers int) *commPWriter {
+	workers = max(workers, 1)
+	return &commPWriter{
+		free:    make(chan *commPBuf, workers),
+		workers: workers,
+	}
+}
+
+func (w *commPWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if w.cur == nil {
+			w.cur = w.buf()
+		}
+
+		c := copy(w.cur.unpadded[w.fill:], p)
+		p = p[c:]
+		w.fill += c
+		w.len += int64(c)
+
+		if w.fill == len(w.cur.unpadded) {
+			w.hashSegment()
+		}
+	}
+	return n, nil
+}
+
+// buf returns a free segment buffer, blocking while every worker is busy.
+func (w *commPWriter) buf() *commPBuf {
+	select {
+	case b := <-w.free:
+		return b
+	default:
+	}
+	if len(w.roots) < w.workers {
+		return &commPBuf{
+			unpadded: make([]byte, commPSegmentSize.Unpadded()),
+			padded:   make([]byte, commPSegmentSize),
+		}
+	}
+	return <-w.free
+}
+
+func (w *commPWriter) hashSegment() {
+	b := w.cur
+	w.cur, w.fill = nil, 0
+
+	root := make(chan [32]byte, 1)
+	w.roots = append(w.roots, root)
+	go func() {
+		fr32.PadSingle(b.unpadded, b.padded)
+		root <- merkleRoot(b.padded)
+		w.free <- b
+	}()
+}
+
+// Sum returns the piece CID and padded piece size of everything written.
+func (w *commPWriter) Sum() (cid.Cid, abi.PaddedPieceSize, error) {
+	var roots [][32]byte
+	size := commPSegmentSize
+
+	switch {
+	case len(w.roots) == 0:
+		// the whole piece fits in a segment, it is only padded to the next
+		// power of two
+		size = paddedPieceSize(w.len)
+		b := w.cur
+		if b == nil {
+			b = w.buf()
+		}
+		clear(b.unpadded[w.fill:size.Unpadded()])
+		fr32.PadSingle(b.unpadded[:size.Unpadded()], b.padded[:size])
+		roots = append(roots, merkleRoot(b.padded[:size]))
+	default:
+		if w.fill > 0 {
+			clear(w.cur.unpadded[w.fill:])
+			w.hashSegment()
+		}
+		for _, root := range w.roots {
+			roots = append(roots, <-root)
+		}
+	}
+
+	// pad the segments with zero subtrees up to a power of two
+	zero := zerocomm.PieceComms[bits.TrailingZeros64(uint64(size))-7]
+	for len(roots)&(len(roots)-1) != 0 {
+		roots = append(roots, zero)
+	}
+	size *= abi.PaddedPieceSize(len(roots))
+
+	nodes := make([]byte, 0, len(roots)*32)
+	for _, root := range roots {
+		nodes = append(nodes, root[:]...)
+	}
+	root := merkleRoot(nodes)
+
+	c, err := commcid.DataCommitmentV1ToCID(root[:])
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	return c, size, nil
+}
+
+// result returns the piece commitment of everything written, in the form
+// commP reports it.
+func (w *commPWriter) result() (*commpResult, error) {
+	pieceCid, pieceSize, err := w.Sum()
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := cidenc.Encoder{Base: multibase.MustNewEncoder(multibase.Base32)}
+
+	return &commpResult{
+		CommPCid:    encoder.Encode(pieceCid),
+		PieceSize:   uint64(pieceSize),
+		CarFileSize: w.len,
+	}, nil
+}
+
+// paddedPieceSize returns the smallest piece that holds size bytes of data.
+func paddedPieceSize(size int64) abi.PaddedPieceSize {
+	padded := uint64(max(size+126, 127) / 127 * 128)
+	return abi.PaddedPieceSize(1 << bits.Len64(padded-1))
+}
+
+// merkleRoot hashes a layer of 32 byte nodes into its sha256-trunc254 binary
+// merkle root, overwriting nodes along the way.
+func merkleRoot(nodes []byte) [32]byte {
+	for len(nodes) > 32 {
+		half := len(nodes) / 2
+		for i := 0; i < half; i += 32 {
+			h := sha256.Sum256(nodes[2*i : 2*i+64])
+			h[31] &= 0x3f
+			copy(nodes[i:], h[:])
+		}
+		nodes = nodes[:half]
+	}
+
+	var root [32]byte
+	copy(root[:], nodes)
+	return root
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/filecoin-project/go-commp-utils/writer"
+	"github.com/filecoin-project/go-commp-utils/zerocomm"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+)
+
+// referenceCommP sums data with writer.Writer, which commPWriter must match.
+func referenceCommP(t *testing.T, data []byte) (cid.Cid, abi.PaddedPieceSize) {
+	t.Helper()
+	w := new(writer.Writer)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := w.Sum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sum.PieceCID, sum.PieceSize
+}
+
+func testCommPData(size int64) []byte {
+	data := make([]byte, size)
+	_, _ = newRandomGenerator(size).ReadAt(data, 0)
+	return data
+}
+
+func TestCommPWriter(t *testing.T) {
+	segment := int64(commPSegmentSize.Unpadded())
+	sizes := []int64{
+		1, 126, 127, 128,
+		int64(writer.CommPBuf) - 1, int64(writer.CommPBuf), int64(writer.CommPBuf) + 1,
+		segment - 1, segment, segment + 1,
+		2 * segment, 4 * segment,
+		// segment counts that are not a power of two
+		3*segment + 5, 5 * segment,
+	}
+
+	for _, size := range sizes {
+		data := testCommPData(size)
+		wantCid, wantSize := referenceCommP(t, data)
+
+		for _, workers := range []int{1, 3} {
+			t.Run(fmt.Sprintf("%d/workers-%d", size, workers), func(t *testing.T) {
+				w := newCommPWriter(workers)
+				// uneven writes cross the segment boundaries anywhere
+				for p := data; len(p) > 0; {
+					n := min(len(p), 1<<20+7)
+					if _, err := w.Write(p[:n]); err != nil {
+						t.Fatal(err)
+					}
+					p = p[n:]
+				}
+
+				gotCid, gotSize, err := w.Sum()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if gotCid != wantCid || gotSize != wantSize {
+					t.Errorf("got %s of %d, want %s of %d", gotCid, gotSize, wantCid, wantSize)
+				}
+			})
+		}
+	}
+
+	// writer.Writer can not sum an empty piece, it is the smallest zero piece
+	t.Run("0", func(t *testing.T) {
+		gotCid, gotSize, err := newCommPWriter(1).Sum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantCid := zerocomm.ZeroPieceCommitment(abi.PaddedPieceSize(128).Unpadded())
+		if gotCid != wantCid || gotSize != 128 {
+			t.Errorf("got %s of %d, want %s of 128", gotCid, gotSize, wantCid)
+		}
+	})
+}
+
+func BenchmarkCommPWriter(b *testing.B) {
+	const size = 256 << 20
+	src := newRandomGenerator(1)
+
+	for _, workers := range []int{1, max(runtime.NumCPU(), 2)} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				w := newCommPWriter(workers)
+				if _, err := io.Copy(w, io.NewSectionReader(src, 0, size)); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := w.Sum(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
+	ihelper "github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/trickle"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-cidutil"
+	chunk "github.com/ipfs/go-ipfs-chunker"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	layoutBalanced = "balanced"
+	layoutTrickle  = "trickle"
+)
+
+var dagLayouts = []string{layoutBalanced, layoutTrickle}
+
+// dagParams controls the shape of the UnixFS DAGs pledge builds, so they can
+// match the DAGs produced by the tools clients actually use.
+type dagParams struct {
+	// Chunker is a go-ipfs-chunker spec: size-<bytes>, rabin[-<min>-<avg>-<max>]
+	// or buzhash.
+	Chunker string
+	// Layout is the file DAG layout, one of dagLayouts.
+	Layout string
+	// MaxLinks is the maximum number of links of every node.
+	MaxLinks int
+	// RawLeaves stores file data in raw blocks instead of UnixFS nodes.
+	RawLeaves bool
+	// CidVersion is 0 or 1, CIDv0 requires sha2-256.
+	CidVersion int
+	// HashFunction is the multihash name used for every CID.
+	HashFunction string
+	// InlineLimit is the largest block that gets an identity CID instead of
+	// being hashed, 0 disables identity CIDs.
+	InlineLimit int
+}
+
+func defaultDagParams() dagParams {
+	return dagParams{
+		Chunker:      fmt.Sprintf("size-%d", unixfsChunkSize),
+		Layout:       layoutBalanced,
+		MaxLinks:     unixfsLinksPerLevel,
+		RawLeaves:    true,
+		CidVersion:   1,
+		HashFunction: multihash.Codes[defaultHashFunction],
+		// NOTE: inlining is not recommended, we are using this to test identity CIDs
+		InlineLimit: 126,
+	}
+}
+
+func (p dagParams) validate() error {
+	if _, err := chunk.FromString(bytes.NewReader(nil), p.Chunker); err != nil {
+		return fmt.Errorf("chunker: %w", err)
+	}
+	if p.Layout != layoutBalanced && p.Layout != layoutTrickle {
+		return fmt.Errorf("unknown dag layout %q, must be one of: %s", p.Layout, strings.Join(dagLayouts, ", "))
+	}
+	if p.MaxLinks < 2 {
+		return fmt.Errorf("max links must be at least 2")
+	}
+	if p.InlineLimit < 0 {
+		return fmt.Errorf("inline limit must not be negative")
+	}
+	_, err := p.cidPrefix()
+	return err
+}
+
+// cidPrefix is the prefix of every non-inlined DAG node CID.
+func (p dagParams) cidPrefix() (cid.Prefix, error) {
+	prefix, err := merkledag.PrefixForCidVersion(p.CidVersion)
+	if err != nil {
+		return cid.Prefix{}, err
+	}
+
+	mhType, ok := multihash.Names[p.HashFunction]
+	if !ok {
+		return cid.Prefix{}, fmt.Errorf("unknown hash function %q", p.HashFunction)
+	}
+	if p.CidVersion == 0 && mhType != multihash.SHA2_256 {
+		return cid.Prefix{}, fmt.Errorf("CIDv0 only supports sha2-256, not %s", p.HashFunction)
+	}
+
+	prefix.MhType = mhType
+	return prefix, nil
+}
+
+func (p dagParams) cidBuilder() (cid.Builder, error) {
+	prefix, err := p.cidPrefix()
+	if err != nil {
+		return nil, err
+	}
+	if p.InlineLimit == 0 {
+		return prefix, nil
+	}
+	return cidutil.InlineBuilder{
+		Builder: prefix,
+		Limit:   p.InlineLimit,
+	}, nil
+}
+
+// blockSize is the nominal chunk size, the fixed size for size chunkers or the
+// target average of content defined ones.
+func (p dagParams) blockSize() int64 {
+	_, avg := p.chunkSizes()
+	return avg
+}
+
+// chunkSizes returns the smallest chunk the chunker cuts, short of the last
+// one of a file, and its nominal chunk size.
+func (p dagParams) chunkSizes() (int64, int64) {
+	parts := strings.Split(p.Chunker, "-")
+	size := func(i int) int64 {
+		if i >= len(parts) {
+			return 0
+		}
+		// rabin sizes may be labeled, e.g. rabin-min:16-avg:64-max:128
+		label := strings.Split(parts[i], ":")
+		n, _ := strconv.ParseInt(label[len(label)-1], 10, 64)
+		return n
+	}
+
+	switch {
+	case parts[0] == "size" && size(1) > 0:
+		return size(1), size(1)
+	case parts[0] == "rabin" && len(parts) == 4:
+		return size(1), size(2)
+	case parts[0] == "rabin" && size(1) > 0:
+		return size(1) / 3, size(1)
+	case parts[0] == "rabin":
+		return chunk.DefaultBlockSize / 3, chunk.DefaultBlockSize
+	case parts[0] == "buzhash":
+		return 128 << 10, chunk.DefaultBlockSize
+	default:
+		return chunk.DefaultBlockSize, chunk.DefaultBlockSize
+	}
+}
+
+func (p dagParams) layout(db *ihelper.DagBuilderHelper) (ipldformat.Node, error) {
+	if p.Layout == layoutTrickle {
+		return trickle.Layout(db)
+	}
+	return balanced.Layout(db)
+}
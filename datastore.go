@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+)
+
+// openDatastore opens the datastore of the repo, which keeps what pledge
+// needs to remember across runs.
+func openDatastore(repo string) (*leveldb.Datastore, error) {
+	return leveldb.NewDatastore(path.Join(repo, "datastore"), nil)
+}
+
+// openRepoDatastore opens the datastore of the repo for commands that only
+// look at it. A run holds it locked until its deals are made.
+func openRepoDatastore(cctx *cli.Context) (*leveldb.Datastore, error) {
+	dir, err := homedir.Expand(cctx.String("repo"))
+	if err != nil {
+		return nil, fmt.Errorf("repo: %w", err)
+	}
+	ds, err := openDatastore(dir)
+	if err != nil {
+		return nil, fmt.Errorf("opening datastore, is pledge running on this repo: %w", err)
+	}
+	return ds, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// the proposal is sent, the provider has not answered yet
+	dealStageProposed = "proposed"
+	// the proposal did not get to the provider or was not answered
+	dealStageFailed = "failed"
+	// the retries ran out after a failed attempt, the provider may have got the
+	// proposal
+	dealStageUnresolved = "unresolved"
+	dealStageRejected   = "rejected"
+	dealStageAccepted   = "accepted"
+	// the provider scheduled the import of the data
+	dealStageImported     = "imported"
+	dealStageImportFailed = "import-failed"
+)
+
+var dealsPrefix = datastore.NewKey("/deals")
+
+// dealRecord is what the datastore keeps about a proposed deal.
+type dealRecord struct {
+	UUID      uuid.UUID
+	Provider  string
+	Wallet    string
+	Root      string
+	PieceCID  string
+	PieceSize uint64
+	CarSize   int64
+	Path      string
+	Created   time.Time
+
+	Stage string
+	// why the deal got to a failed stage
+	Error       string                     `json:",omitempty"`
+	Proposal    *market.ClientDealProposal `json:",omitempty"`
+	Response    string                     `json:",omitempty"`
+	Transitions []dealTransition
+}
+
+type dealTransition struct {
+	Stage string
+	At    time.Time
+	Error string `json:",omitempty"`
+}
+
+// advance moves the deal to stage, failed with err if it is not nil, and
+// saves it.
+func (d *dealRecord) advance(ctx context.Context, ds datastore.Datastore, stage string, err error) error {
+	d.Stage = stage
+	d.Error = ""
+	if err != nil {
+		d.Error = err.Error()
+	}
+	d.Transitions = append(d.Transitions, dealTransition{Stage: stage, At: time.Now(), Error: d.Error})
+	if err := putDeal(ctx, ds, d); err != nil {
+		return fmt.Errorf("recording deal %s: %w", d.UUID, err)
+	}
+	return nil
+}
+
+func dealKey(id uuid.UUID) datastore.Key {
+	return dealsPrefix.ChildString(id.String())
+}
+
+func putDeal(ctx context.Context, ds datastore.Datastore, d *dealRecord) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return ds.Put(ctx, dealKey(d.UUID), b)
+}
+
+func getDeal(ctx context.Context, ds datastore.Datastore, id uuid.UUID) (*dealRecord, error) {
+	b, err := ds.Get(ctx, dealKey(id))
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil, fmt.Errorf("no deal %s in the repo", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d dealRecord
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, fmt.Errorf("deal %s: %w", id, err)
+	}
+	return &d, nil
+}
+
+// listDeals returns the deals in the order they were made.
+func listDeals(ctx context.Context, ds datastore.Datastore) ([]*dealRecord, error) {
+	res, err := ds.Query(ctx, query.Query{Prefix: dealsPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close() // nolint:errcheck
+
+	var deals []*dealRecord
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var d dealRecord
+		if err := json.Unmarshal(r.Value, &d); err != nil {
+			return nil, fmt.Errorf("deal %s: %w", r.Key, err)
+		}
+		deals = append(deals, &d)
+	}
+	sort.Slice(deals, func(i, j int) bool {
+		return deals[i].Created.Before(deals[j].Created)
+	})
+	return deals, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bapi "github.com/filecoin-project/boost/api"
+	"github.com/filecoin-project/boost/storagemarket/types/dealcheckpoints"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+)
+
+const (
+	// proposed, boost has not imported the data yet
+	dealStatePending  = "pending"
+	dealStateImported = "imported"
+	// the deal is on chain
+	dealStatePublished = "published"
+	// the sector of the deal is proven on chain
+	dealStateSealed = "sealed"
+	// the sector of the deal is proven and the deal activated
+	dealStateActive = "active"
+	// the deal ran its term and left the chain
+	dealStateExpired = "expired"
+	dealStateFailed  = "failed"
+	// the boost node of the provider could not tell
+	dealStateUnknown = "unknown"
+)
+
+// defaultStuckAfter is how long a deal goes without progress until it is stuck.
+const defaultStuckAfter = 24 * time.Hour
+
+// dealStates are the states a deal goes through, in order.
+var dealStates = []string{dealStatePending, dealStateImported, dealStatePublished, dealStateSealed, dealStateActive}
+
+// dealStateReached reports whether state is at least as far as target.
+func dealStateReached(state, target string) bool {
+	if state == dealStateExpired {
+		return true
+	}
+	idx := func(s string) int {
+		for i, st := range dealStates {
+			if st == s {
+				return i
+			}
+		}
+		return -1
+	}
+	return state != dealStateFailed && idx(state) >= idx(target)
+}
+
+// dealStatus is where a deal is at, from the repo, boost and the chain.
+type dealStatus struct {
+	UUID     uuid.UUID
+	Provider string
+	PieceCID string
+	Stage    string
+
+	// at boost, Checkpoint is empty when boost does not know the deal
+	Checkpoint   string
+	CheckpointAt time.Time
+	SectorID     abi.SectorNumber
+	ChainDealID  abi.DealID
+	BoostError   string `json:",omitempty"`
+
+	// on chain, -1 until they happen
+	PublishEpoch    abi.ChainEpoch
+	ActivationEpoch abi.ChainEpoch
+	SlashEpoch      abi.ChainEpoch
+
+	State string
+	// the deal made no progress for longer than it should take
+	Stuck bool
+	// why the deal failed or is stuck
+	Problem string `json:",omitempty"`
+}
+
+// dealTracker looks deals up at the boost node of their provider and on chain.
+type dealTracker struct {
+	boost      map[string]bapi.Boost
+	chain      api.Gateway
+	stuckAfter time.Duration
+}
+
+func (t *dealTracker) status(ctx context.Context, head *types.TipSet, d *dealRecord) (*dealStatus, error) {
+	s := &dealStatus{
+		UUID:            d.UUID,
+		Provider:        d.Provider,
+		PieceCID:        d.PieceCID,
+		Stage:           d.Stage,
+		PublishEpoch:    -1,
+		ActivationEpoch: -1,
+		SlashEpoch:      -1,
+		State:           dealStatePending,
+	}
+	progress := d.Created
+	if len(d.Transitions) > 0 {
+		progress = d.Transitions[len(d.Transitions)-1].At
+	}
+
+	switch d.Stage {
+	case dealStageRejected, dealStageFailed, dealStageImportFailed:
+		s.State = dealStateFailed
+		s.Problem = d.Error
+		return s, nil
+	case dealStageImported:
+		s.State = dealStateImported
+	}
+
+	boost, ok := t.boost[d.Provider]
+	if !ok {
+		s.State = dealStateUnknown
+		s.Problem = "no boost api for the provider, give it with --provider <address>@<boost-api-info>"
+		return s, nil
+	}
+	bd, err := boostDeal(ctx, boost, d.UUID)
+	if err != nil {
+		s.State = dealStateUnknown
+		s.Problem = fmt.Sprintf("getting the deal from boost: %s", err)
+		return s, nil
+	}
+	if d.Stage == dealStageUnresolved && bd == nil {
+		s.State = dealStateFailed
+		s.Problem = "the provider never got the proposal: " + d.Error
+		return s, nil
+	}
+	if d.Stage == dealStageUnresolved {
+		s.Problem = "the provider got the proposal of a failed attempt, its data was not imported"
+	}
+	if bd != nil {
+		s.Checkpoint = bd.Checkpoint.String()
+		s.CheckpointAt = bd.CheckpointAt
+		s.SectorID = bd.SectorID
+		s.ChainDealID = bd.ChainDealID
+		s.BoostError = bd.Err
+		progress = bd.CheckpointAt
+
+		// boost may still be importing the data it was handed
+		if bd.Checkpoint < dealcheckpoints.Transferred {
+			s.State = dealStatePending
+		}
+		if bd.Checkpoint >= dealcheckpoints.PublishConfirmed {
+			s.State = dealStatePublished
+		}
+		if bd.Checkpoint >= dealcheckpoints.AddedPiece {
+			// the piece is only handed to the sealer, wait for the sector
+			maddr, err := address.NewFromString(d.Provider)
+			if err != nil {
+				return nil, fmt.Errorf("provider of deal %s: %w", d.UUID, err)
+			}
+			si, err := t.chain.StateSectorGetInfo(ctx, maddr, bd.SectorID, head.Key())
+			if err != nil {
+				return nil, fmt.Errorf("getting sector %d of deal %s from chain: %w", bd.SectorID, d.UUID, err)
+			}
+			if si != nil {
+				s.State = dealStateSealed
+			}
+		}
+		if bd.PublishCID != nil {
+			lookup, err := t.chain.StateSearchMsg(ctx, head.Key(), *bd.PublishCID, api.LookbackNoLimit, true)
+			if err != nil {
+				return nil, fmt.Errorf("looking up publish message of deal %s: %w", d.UUID, err)
+			}
+			if lookup != nil {
+				s.PublishEpoch = lookup.Height
+			}
+		}
+	}
+
+	startEpoch, endEpoch := abi.ChainEpoch(-1), abi.ChainEpoch(-1)
+	if d.Proposal != nil {
+		startEpoch, endEpoch = d.Proposal.Proposal.StartEpoch, d.Proposal.Proposal.EndEpoch
+	}
+	if s.ChainDealID != 0 {
+		md, err := t.chain.StateMarketStorageDeal(ctx, s.ChainDealID, head.Key())
+		// errors lose their type over RPC
+		if err != nil && !strings.Contains(err.Error(), fmt.Sprintf("deal %d not found", s.ChainDealID)) {
+			return nil, fmt.Errorf("getting deal %d from chain: %w", s.ChainDealID, err)
+		}
+		if err != nil {
+			// expired, slashed or not activated in time
+			if endEpoch > -1 && head.Height() >= endEpoch {
+				s.State = dealStateExpired
+				return s, nil
+			}
+			s.State = dealStateFailed
+			s.Problem = fmt.Sprintf("deal %d is not on chain, it was slashed or not sealed before its start epoch", s.ChainDealID)
+			return s, nil
+		}
+		startEpoch = md.Proposal.StartEpoch
+		s.ActivationEpoch = md.State.SectorStartEpoch
+		s.SlashEpoch = md.State.SlashEpoch
+		if s.ActivationEpoch > -1 {
+			s.State = dealStateActive
+		}
+	}
+
+	switch {
+	case s.BoostError != "":
+		s.State = dealStateFailed
+		s.Problem = "boost: " + s.BoostError
+	case s.SlashEpoch > -1:
+		s.State = dealStateFailed
+		s.Problem = fmt.Sprintf("slashed at epoch %d", s.SlashEpoch)
+	case s.ActivationEpoch == -1 && startEpoch > -1 && head.Height() > startEpoch:
+		s.State = dealStateFailed
+		s.Problem = fmt.Sprintf("not sealed before its start epoch %d", startEpoch)
+	case s.State != dealStateActive && time.Since(progress) > t.stuckAfter:
+		s.Stuck = true
+		s.Problem = fmt.Sprintf("no progress since %s", progress.Format(time.DateTime))
+		if s.Checkpoint == "" {
+			s.Problem += ", boost does not know the deal"
+		}
+	}
+	return s, nil
+}
+
+// wait follows the deals until every one got to target or failed.
+func (t *dealTracker) wait(ctx context.Context, deals []*dealRecord, target string, timeout, interval time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var failed int
+	for {
+		waiting, n, err := t.poll(ctx, deals, target)
+		if err != nil {
+			log.Warnw("failed to follow deals, trying again", "in", interval, "err", err)
+		} else {
+			deals = waiting
+			failed += n
+		}
+
+		if len(deals) == 0 {
+			if failed > 0 {
+				return fmt.Errorf("%d deals failed", failed)
+			}
+			return nil
+		}
+		log.Infow("waiting for deals", "state", target, "waiting", len(deals), "failed", failed)
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("%d deals did not get %s within %s, %d failed", len(deals), target, timeout, failed)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// poll returns the deals still on their way to target and how many failed.
+func (t *dealTracker) poll(ctx context.Context, deals []*dealRecord, target string) ([]*dealRecord, int, error) {
+	head, err := t.chain.ChainHead(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot get chain head: %w", err)
+	}
+
+	var waiting []*dealRecord
+	var failed int
+	for _, d := range deals {
+		s, err := t.status(ctx, head, d)
+		switch {
+		case err != nil:
+			log.Warnw("failed to get deal status, trying again", "uuid", d.UUID, "provider", d.Provider, "err", err)
+			waiting = append(waiting, d)
+		case s.State == dealStateFailed:
+			failed++
+			log.Errorw("deal failed", "uuid", d.UUID, "provider", d.Provider, "checkpoint", s.Checkpoint, "problem", s.Problem)
+		case s.State == dealStateUnknown:
+			log.Warnw("failed to get deal status, trying again", "uuid", d.UUID, "provider", d.Provider, "problem", s.Problem)
+			waiting = append(waiting, d)
+		case dealStateReached(s.State, target):
+			log.Infow("deal reached", "state", target, "uuid", d.UUID, "provider", d.Provider, "deal-id", s.ChainDealID, "sector", s.SectorID, "epoch", head.Height())
+		default:
+			if s.Stuck {
+				log.Warnw("deal is stuck", "uuid", d.UUID, "provider", d.Provider, "state", s.State, "checkpoint", s.Checkpoint, "problem", s.Problem)
+			}
+			waiting = append(waiting, d)
+		}
+	}
+	return waiting, failed, nil
+}
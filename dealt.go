@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// dealtPrefix keys the cars a provider accepted a deal for, which gc keeps
+// for the provider to import.
+var dealtPrefix = datastore.NewKey("/dealt")
+
+func dealtKey(path string) datastore.Key {
+	return dealtPrefix.Child(datastore.NewKey(absPath(path)))
+}
+
+func markDealt(ctx context.Context, ds datastore.Datastore, path string, dealUuid uuid.UUID) error {
+	return ds.Put(ctx, dealtKey(path), []byte(dealUuid.String()))
+}
+
+// dealtCars returns the absolute paths of the cars deals were made for.
+func dealtCars(ctx context.Context, ds datastore.Datastore) (map[string]bool, error) {
+	res, err := ds.Query(ctx, query.Query{Prefix: dealtPrefix.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close() // nolint:errcheck
+
+	cars := map[string]bool{}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		cars[strings.TrimPrefix(r.Key, dealtPrefix.String())] = true
+	}
+	return cars, nil
+}
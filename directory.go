@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/boxo/ipld/unixfs/hamt"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	"github.com/ipfs/go-cid"
+
+	ipldformat "github.com/ipfs/go-ipld-format"
+)
+
+const (
+	fileSizesEqual   = "equal"
+	fileSizesUniform = "uniform"
+	fileSizesPareto  = "pareto"
+)
+
+var fileSizeDists = []string{fileSizesEqual, fileSizesUniform, fileSizesPareto}
+
+// paretoAlpha shapes the pareto file size distribution, lower values give a
+// longer tail of a few very large files among many small ones.
+const paretoAlpha = 1.2
+
+// dirLayout describes the UnixFS directory tree a payload is split into.
+type dirLayout struct {
+	// Files is the number of files the payload is split into.
+	Files int
+	// Depth is the number of directory levels below the root the files are
+	// spread over, 0 puts every file in the root directory.
+	Depth int
+	// SizeDist is how the payload is divided among the files, one of
+	// fileSizeDists.
+	SizeDist string
+	// HAMT forces every directory to be a HAMT shard, otherwise directories
+	// are only sharded once they grow past the default UnixFS threshold.
+	HAMT bool
+	// Seed drives the file sizes.
+	Seed int64
+}
+
+func (l dirLayout) validate() error {
+	if l.Files < 1 {
+		return fmt.Errorf("directory must have at least one file")
+	}
+	if l.Depth < 0 {
+		return fmt.Errorf("directory depth must not be negative")
+	}
+	for _, d := range fileSizeDists {
+		if l.SizeDist == d {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown file size distribution %q, must be one of: %s", l.SizeDist, strings.Join(fileSizeDists, ", "))
+}
+
+// fileSizes divides size among the files of the layout.
+func (l dirLayout) fileSizes(size int64) []int64 {
+	rng := rand.New(rand.NewSource(l.Seed))
+	weights := make([]float64, l.Files)
+	var total float64
+	for i := range weights {
+		switch l.SizeDist {
+		case fileSizesUniform:
+			weights[i] = rng.Float64()
+		case fileSizesPareto:
+			weights[i] = 1 / math.Pow(1-rng.Float64(), 1/paretoAlpha)
+		default:
+			weights[i] = 1
+		}
+		total += weights[i]
+	}
+
+	sizes := make([]int64, l.Files)
+	var assigned int64
+	for i, w := range weights {
+		sizes[i] = int64(float64(size) * w / total)
+		assigned += sizes[i]
+	}
+	sizes[len(sizes)-1] += size - assigned
+	return sizes
+}
+
+// filePath returns the directories and the name of the i-th file. Files are
+// spread evenly over fanout^Depth leaf directories.
+func (l dirLayout) filePath(i int) ([]string, string) {
+	name := fmt.Sprintf("file-%06d", i)
+	if l.Depth == 0 {
+		return nil, name
+	}
+
+	fanout := int(math.Ceil(math.Pow(float64(l.Files), 1/float64(l.Depth+1))))
+	fanout = max(fanout, 2)
+	leaves := int(math.Pow(float64(fanout), float64(l.Depth)))
+
+	// consecutive files share a leaf, leaves get the same number of files
+	// give or take one
+	leaf := int(int64(i) * int64(leaves) / int64(l.Files))
+	dirs := make([]string, l.Depth)
+	for d := l.Depth - 1; d >= 0; d-- {
+		dirs[d] = fmt.Sprintf("dir-%03d", leaf%fanout)
+		leaf /= fanout
+	}
+	return dirs, name
+}
+
+// CreateDirectoryCAR writes src as the files of a UnixFS directory into a CAR.
+func CreateDirectoryCAR(dir string, src dataSource, size int64, layout dirLayout, params dagParams, format carFormat) (cid.Cid, string, error) {
+	if err := layout.validate(); err != nil {
+		return cid.Undef, "", err
+	}
+	return CreateDenseCARWith(dir, unixfsDirectoryDAG(src, size, layout, params), params, format)
+}
+
+// unixfsDirectoryDAG imports src as the files of a UnixFS directory tree.
+func unixfsDirectoryDAG(src dataSource, size int64, layout dirLayout, params dagParams) dagWriter {
+	return func(into ipldformat.DAGService) (cid.Cid, error) {
+		ctx := context.Background()
+
+		r, err := src()
+		if err != nil {
+			return cid.Undef, err
+		}
+		defer r.Close() // nolint:errcheck
+
+		prefix, err := params.cidPrefix()
+		if err != nil {
+			return cid.Undef, err
+		}
+
+		root, err := newDirTree(into, prefix, layout.HAMT)
+		if err != nil {
+			return cid.Undef, err
+		}
+
+		for i, fs := range layout.fileSizes(size) {
+			nd, err := writeUnixfsFile(io.LimitReader(r, fs), into, params)
+			if err != nil {
+				return cid.Undef, err
+			}
+
+			dirs, name := layout.filePath(i)
+			parent, err := root.subdir(dirs)
+			if err != nil {
+				return cid.Undef, err
+			}
+			if err := parent.dir.AddChild(ctx, name, nd); err != nil {
+				return cid.Undef, fmt.Errorf("adding %s: %w", path.Join(append(dirs, name)...), err)
+			}
+		}
+
+		nd, err := root.finalize(ctx)
+		if err != nil {
+			return cid.Undef, err
+		}
+		return nd.Cid(), nil
+	}
+}
+
+// unixfsDir is the part of a UnixFS directory, basic or sharded, needed to
+// build one.
+type unixfsDir interface {
+	AddChild(ctx context.Context, name string, nd ipldformat.Node) error
+	GetNode() (ipldformat.Node, error)
+}
+
+// hamtDir forces a directory to be sharded no matter its size.
+type hamtDir struct {
+	*hamt.Shard
+}
+
+func (d hamtDir) AddChild(ctx context.Context, name string, nd ipldformat.Node) error {
+	return d.Set(ctx, name, nd)
+}
+
+func (d hamtDir) GetNode() (ipldformat.Node, error) {
+	return d.Node()
+}
+
+type dirTree struct {
+	into    ipldformat.DAGService
+	prefix  cid.Prefix
+	hamt    bool
+	dir     unixfsDir
+	subdirs map[string]*dirTree
+}
+
+func newDirTree(into ipldformat.DAGService, prefix cid.Prefix, sharded bool) (*dirTree, error) {
+	t := &dirTree{
+		into:    into,
+		prefix:  prefix,
+		hamt:    sharded,
+		subdirs: make(map[string]*dirTree),
+	}
+
+	if sharded {
+		shard, err := hamt.NewShard(into, uio.DefaultShardWidth)
+		if err != nil {
+			return nil, err
+		}
+		shard.SetCidBuilder(prefix)
+		t.dir = hamtDir{shard}
+	} else {
+		d := uio.NewDirectory(into)
+		d.SetCidBuilder(prefix)
+		t.dir = d
+	}
+	return t, nil
+}
+
+func (t *dirTree) subdir(dirs []string) (*dirTree, error) {
+	if len(dirs) == 0 {
+		return t, nil
+	}
+
+	sub, ok := t.subdirs[dirs[0]]
+	if !ok {
+		var err error
+		sub, err = newDirTree(t.into, t.prefix, t.hamt)
+		if err != nil {
+			return nil, err
+		}
+		t.subdirs[dirs[0]] = sub
+	}
+	return sub.subdir(dirs[1:])
+}
+
+// finalize writes the directory nodes of the tree bottom up and returns the
+// node of t.
+func (t *dirTree) finalize(ctx context.Context) (ipldformat.Node, error) {
+	names := make([]string, 0, len(t.subdirs))
+	for name := range t.subdirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		nd, err := t.subdirs[name].finalize(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.dir.AddChild(ctx, name, nd); err != nil {
+			return nil, fmt.Errorf("adding directory %s: %w", name, err)
+		}
+	}
+
+	nd, err := t.dir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.into.Add(ctx, nd); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
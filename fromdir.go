@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cidutil/cidenc"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipld/go-car/v2"
+	"github.com/multiformats/go-multibase"
+)
+
+const (
+	carStatusProposed = "proposed"
+	carStatusImported = "imported"
+)
+
+// carRecord is the cached commP of a --from-dir CAR and how far dealing it got.
+type carRecord struct {
+	Path      string
+	Size      int64
+	ModTime   time.Time
+	Root      string
+	PieceCID  string
+	PieceSize uint64
+	Status    string
+	DealUUID  string
+	Updated   time.Time
+}
+
+// carDir deals the existing CARs of a directory, each of them once.
+type carDir struct {
+	ds      datastore.Datastore
+	workers int
+	files   []string
+}
+
+func openCarDir(dir string, ds datastore.Datastore, workers int) (*carDir, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.car"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no car files in %s", dir)
+	}
+	sort.Strings(files)
+
+	for i, f := range files {
+		if files[i], err = filepath.Abs(f); err != nil {
+			return nil, err
+		}
+	}
+	return &carDir{ds: ds, workers: workers, files: files}, nil
+}
+
+func carRecordKey(path string) datastore.Key {
+	return datastore.NewKey("/cars").Child(datastore.NewKey(path))
+}
+
+func (d *carDir) record(ctx context.Context, path string) (*carRecord, error) {
+	b, err := d.ds.Get(ctx, carRecordKey(path))
+	if errors.Is(err, datastore.ErrNotFound) {
+		return &carRecord{Path: path}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r carRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("record of %s: %w", path, err)
+	}
+	return &r, nil
+}
+
+func (d *carDir) save(ctx context.Context, r *carRecord) error {
+	r.Updated = time.Now()
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return d.ds.Put(ctx, carRecordKey(r.Path), b)
+}
+
+// next returns the next CAR that has not been dealt yet, or nil once every
+// CAR of the directory has been.
+func (d *carDir) next(ctx context.Context) (*piece, error) {
+	for len(d.files) > 0 {
+		path := d.files[0]
+		d.files = d.files[1:]
+
+		r, err := d.record(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		if r.Status != "" {
+			log.Debugw("skip car, already used", "path", path, "status", r.Status, "deal", r.DealUUID)
+			continue
+		}
+
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if r.PieceCID == "" || r.Size != stat.Size() || !r.ModTime.Equal(stat.ModTime()) {
+			if err := d.inspect(path, r); err != nil {
+				return nil, err
+			}
+			r.Size, r.ModTime = stat.Size(), stat.ModTime()
+			if err := d.save(ctx, r); err != nil {
+				return nil, err
+			}
+		} else {
+			log.Infow("commP cached", "path", path, "piece", r.PieceCID)
+		}
+
+		return &piece{
+			Root:      r.Root,
+			PieceCID:  r.PieceCID,
+			PieceSize: r.PieceSize,
+			CarSize:   r.Size,
+			Size:      r.Size,
+			Path:      path,
+		}, nil
+	}
+	return nil, nil
+}
+
+// inspect reads the root of a CAR from its header and calculates its commP.
+func (d *carDir) inspect(path string, r *carRecord) error {
+	cr, err := car.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+	roots, err := cr.Roots()
+	_ = cr.Close()
+	if err != nil {
+		return fmt.Errorf("reading roots of %s: %w", path, err)
+	}
+	if len(roots) != 1 {
+		return fmt.Errorf("car %s has %d roots, expected 1", path, len(roots))
+	}
+
+	cp, err := commP(path, d.workers)
+	if err != nil {
+		return err
+	}
+
+	encoder := cidenc.Encoder{Base: multibase.MustNewEncoder(multibase.Base32)}
+	r.Root = encoder.Encode(roots[0])
+	r.PieceCID = cp.CommPCid
+	r.PieceSize = cp.PieceSize
+	return nil
+}
+
+// markUsed records how far dealing the CAR of p got, so it is not dealt again.
+func (d *carDir) markUsed(ctx context.Context, p *piece, status string, dealUuid uuid.UUID) error {
+	r, err := d.record(ctx, p.Path)
+	if err != nil {
+		return err
+	}
+	r.Status = status
+	r.DealUUID = dealUuid.String()
+	return d.save(ctx, r)
+}
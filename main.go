@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -33,21 +34,33 @@ func main() {
 		Commands: []*cli.Command{
 			initCmd,
 			runCmd,
+			generateCmd,
 			marketAddCmd,
 			walletCmd,
+			commPCmd,
+			verifyCarCmd,
+			gcCmd,
+			dealsCmd,
 		},
 	}
 
 	app.Setup()
 
-	c := make(chan os.Signal, 1)
+	// the first signal cancels the context of the command, which winds down
+	// what it is doing, the second one exits right away
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 2)
 	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
 		<-c
+		log.Warn("shutting down, interrupt again to exit right away")
+		cancel()
+		<-c
+		tempFiles.cleanup()
 		os.Exit(1)
 	}()
 
-	if err := app.Run(os.Args); err != nil {
+	if err := app.RunContext(ctx, os.Args); err != nil {
 		fmt.Printf("ERROR: %s\n\n", err) // nolint:errcheck
 		os.Exit(1)
 	}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-cidutil/cidenc"
+	"github.com/multiformats/go-multibase"
+	"github.com/urfave/cli/v2"
+)
+
+// pieceFlags control how pieces are generated, shared by run and generate.
+var pieceFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "min-size",
+		Usage: "min size of the car file",
+		Value: "1GiB",
+	},
+	&cli.StringFlag{
+		Name:  "max-size",
+		Usage: "max size of the car file",
+		Value: "31GiB",
+	},
+	&cli.StringFlag{
+		Name:  "piece-size",
+		Usage: "padded piece size to fill with the largest car that fits, e.g. 32GiB, same as --size-distribution ladder:<size>",
+	},
+	&cli.StringFlag{
+		Name:  "size-distribution",
+		Usage: "distribution of the car sizes: uniform, fixed:<size>, weighted:<size>=<weight>,..., normal:<mean>,<stddev>, lognormal:<median>,<sigma> or ladder[:<piece size>,...]",
+		Value: sizeDistUniform,
+	},
+	&cli.Int64Flag{
+		Name:  "seed",
+		Usage: "seed for the random data and sizes, if not specified, a random seed is used",
+	},
+	&cli.IntFlag{
+		Name:  "gen-workers",
+		Usage: "number of goroutines generating random data in parallel",
+		Value: runtime.NumCPU(),
+	},
+	&cli.IntFlag{
+		Name:  "commp-workers",
+		Usage: "number of goroutines hashing the piece commitment in parallel",
+		Value: runtime.NumCPU(),
+	},
+	&cli.StringFlag{
+		Name:  "data-profile",
+		Usage: fmt.Sprintf("content of the generated data, one of: %s", strings.Join(dataProfiles, ", ")),
+		Value: profileRandom,
+	},
+	&cli.Float64Flag{
+		Name:  "dup-ratio",
+		Usage: "share of blocks duplicated by the repeat and mix data profiles, between 0 and 1",
+		Value: 0.5,
+	},
+	&cli.IntFlag{
+		Name:  "dir-files",
+		Usage: "split the data into this many files of a UnixFS directory, if not specified, the car holds a single file",
+	},
+	&cli.IntFlag{
+		Name:  "dir-depth",
+		Usage: "number of directory levels the files are spread over",
+	},
+	&cli.StringFlag{
+		Name:  "dir-size-dist",
+		Usage: fmt.Sprintf("how the data is divided among the files, one of: %s", strings.Join(fileSizeDists, ", ")),
+		Value: fileSizesEqual,
+	},
+	&cli.BoolFlag{
+		Name:  "dir-hamt",
+		Usage: "shard every directory as a HAMT regardless of its size",
+	},
+	&cli.StringFlag{
+		Name:  "car-format",
+		Usage: fmt.Sprintf("car container, one of: %s, v2-sidecar writes the index to <car>.idx", strings.Join(carFormats, ", ")),
+		Value: defaultCARFormat().Format,
+	},
+	&cli.StringFlag{
+		Name:  "index-codec",
+		Usage: "multicodec of the CARv2 index, car-index-sorted or car-multihash-index-sorted",
+		Value: defaultCARFormat().IndexCodec,
+	},
+	&cli.StringFlag{
+		Name:  "chunker",
+		Usage: "file chunker: size-<bytes>, rabin[-<min>-<avg>-<max>] or buzhash",
+		Value: defaultDagParams().Chunker,
+	},
+	&cli.StringFlag{
+		Name:  "dag-layout",
+		Usage: fmt.Sprintf("file DAG layout, one of: %s", strings.Join(dagLayouts, ", ")),
+		Value: defaultDagParams().Layout,
+	},
+	&cli.IntFlag{
+		Name:  "max-links",
+		Usage: "maximum number of links per DAG node",
+		Value: defaultDagParams().MaxLinks,
+	},
+	&cli.BoolFlag{
+		Name:  "raw-leaves",
+		Usage: "store file data in raw leaves instead of UnixFS nodes",
+		Value: defaultDagParams().RawLeaves,
+	},
+	&cli.IntFlag{
+		Name:  "cid-version",
+		Usage: "CID version of the DAG nodes, CIDv0 requires sha2-256",
+		Value: defaultDagParams().CidVersion,
+	},
+	&cli.StringFlag{
+		Name:  "hash",
+		Usage: "multihash function of the DAG nodes, e.g. sha2-256 or blake2b-256",
+		Value: defaultDagParams().HashFunction,
+	},
+	&cli.IntFlag{
+		Name:  "inline-limit",
+		Usage: "blocks up to this size get identity CIDs, 0 disables identity CIDs",
+		Value: defaultDagParams().InlineLimit,
+	},
+}
+
+// piece is a CAR ready to be dealt and what pledge knows about it.
+type piece struct {
+	Root      string
+	PieceCID  string
+	PieceSize uint64
+	CarSize   int64
+	// Size is the payload size the CAR was generated from.
+	Size      int64
+	Seed      int64
+	Profile   string
+	CarFormat string
+	Created   time.Time
+
+	// Path is where the CAR currently is.
+	Path string `json:"-"`
+}
+
+// pieceGenerator draws the size and seed of every piece from a single seed, so
+// both a whole run and any single piece can be reproduced.
+type pieceGenerator struct {
+	cctx     *cli.Context
+	params   dagParams
+	format   carFormat
+	layout   *dirLayout
+	profile  string
+	dupRatio float64
+	sizes    sizeDistribution
+	seed     int64
+	rng      *rand.Rand
+}
+
+func newPieceGenerator(cctx *cli.Context) (*pieceGenerator, error) {
+	g := &pieceGenerator{
+		cctx:     cctx,
+		params:   dagParamsFromFlags(cctx),
+		format:   carFormatFromFlags(cctx),
+		profile:  cctx.String("data-profile"),
+		dupRatio: cctx.Float64("dup-ratio"),
+	}
+
+	carMinSize, err := units.RAMInBytes(cctx.String("min-size"))
+	if err != nil {
+		return nil, fmt.Errorf("min size: %w", err)
+	}
+	carMaxSize, err := units.RAMInBytes(cctx.String("max-size"))
+	if err != nil {
+		return nil, fmt.Errorf("max size: %w", err)
+	}
+	if carMinSize > carMaxSize {
+		return nil, fmt.Errorf("min size is greater than max size")
+	}
+	if err := g.params.validate(); err != nil {
+		return nil, err
+	}
+	if err := g.format.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := newDataProfile(g.profile, 0, g.params.blockSize(), g.dupRatio); err != nil {
+		return nil, err
+	}
+	if cctx.IsSet("dir-files") {
+		l := dirLayoutFromFlags(cctx, 0)
+		if err := l.validate(); err != nil {
+			return nil, err
+		}
+		g.layout = &l
+	}
+
+	spec := cctx.String("size-distribution")
+	if cctx.IsSet("piece-size") {
+		if cctx.IsSet("size-distribution") {
+			return nil, fmt.Errorf("piece size and size distribution are mutually exclusive")
+		}
+		spec = sizeDistLadder + ":" + cctx.String("piece-size")
+	}
+	g.sizes, err = parseSizeDistribution(spec, carMinSize, carMaxSize, g.params, g.layout)
+	if err != nil {
+		return nil, fmt.Errorf("size distribution: %w", err)
+	}
+	// ladder payloads are sized for unique blocks, deduped ones would leave the
+	// CAR short of its piece
+	if _, ok := g.sizes.(pieceLadder); ok && profileDedupes(g.profile, g.dupRatio) {
+		return nil, fmt.Errorf("piece sizes can not be filled with the %s data profile, it repeats blocks", g.profile)
+	}
+
+	g.seed = time.Now().UnixNano()
+	if cctx.IsSet("seed") {
+		g.seed = cctx.Int64("seed")
+	}
+	log.Infow("random seed", "seed", g.seed)
+	g.rng = rand.New(rand.NewSource(g.seed))
+
+	return g, nil
+}
+
+// pieceSpec is what a piece is generated from.
+type pieceSpec struct {
+	size      int64
+	seed      int64
+	pieceSize abi.PaddedPieceSize
+}
+
+// sample draws the size and seed of the next piece.
+func (g *pieceGenerator) sample() pieceSpec {
+	size, pieceSize := g.sizes.sample(g.rng)
+	return pieceSpec{size: size, seed: g.rng.Int63(), pieceSize: pieceSize}
+}
+
+// next generates the next piece into carPath.
+func (g *pieceGenerator) next(ctx context.Context, carPath string, space *spaceGuard) (*piece, error) {
+	spec := g.sample()
+	p, err := g.build(ctx, carPath, spec, space)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.place(p, spec); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// build writes the CAR of a piece into carPath under a temp name, once space
+// admits it.
+func (g *pieceGenerator) build(ctx context.Context, carPath string, spec pieceSpec, space *spaceGuard) (*piece, error) {
+	need, err := estimateCARSize(spec.size, g.params, g.layout)
+	if err != nil {
+		return nil, err
+	}
+	release, err := space.admit(ctx, map[string]int64{carPath: need})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	start := time.Now()
+
+	gen, err := newDataProfile(g.profile, spec.seed, g.params.blockSize(), g.dupRatio)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("create car file, size: %d, seed: %d, profile: %s", spec.size, spec.seed, g.profile)
+	src := generatedSource(ctx, gen, spec.size, g.cctx.Int("gen-workers"))
+	// stage the car next to its final name so it can be renamed into place
+	var root cid.Cid
+	var cn string
+	if g.layout != nil {
+		layout := *g.layout
+		layout.Seed = spec.seed
+		root, cn, err = CreateDirectoryCAR(carPath, src, spec.size, layout, g.params, g.format)
+	} else {
+		root, cn, err = CreateDenseCAR(carPath, src, g.params, g.format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := cidenc.Encoder{Base: multibase.MustNewEncoder(multibase.Base32)}
+	rn := encoder.Encode(root)
+	log.Infow("create car file", "path", cn, "cid", rn, "duration", time.Since(start))
+
+	return &piece{
+		Root:      rn,
+		Size:      spec.size,
+		Seed:      spec.seed,
+		Profile:   g.profile,
+		CarFormat: g.format.Format,
+		Path:      cn,
+	}, nil
+}
+
+// place moves the CAR of a built piece into place and calculates its piece
+// commitment, which must fill the padded piece size of spec if it has one.
+func (g *pieceGenerator) place(p *piece, spec pieceSpec) error {
+	cn := p.Path
+	np, err := reserveCarName(filepath.Dir(cn), p.Root)
+	if err != nil {
+		return err
+	}
+
+	// the piece stays in flight until the caller settles it
+	tempFiles.track(np, sidecarIndexPath(np))
+	defer tempFiles.untrack(cn, sidecarIndexPath(cn))
+	if g.format.Format == carFormatV2Sidecar {
+		if _, err := MoveFile(sidecarIndexPath(cn), sidecarIndexPath(np)); err != nil {
+			return err
+		}
+	}
+	// the piece is the car file alone, the sidecar index is not imported
+	cp, err := moveFileCommP(cn, np, g.cctx.Int("commp-workers"))
+	if err != nil {
+		return err
+	}
+	log.Infow("piece generated", "seed", p.Seed, "size", p.Size, "profile", g.profile, "root", p.Root, "piece", cp.CommPCid, "piece-size", cp.PieceSize, "car-size", cp.CarFileSize)
+
+	if spec.pieceSize != 0 && abi.PaddedPieceSize(cp.PieceSize) != spec.pieceSize {
+		return fmt.Errorf("car file %s of %d bytes does not fill a piece of %d bytes, got %d", np, cp.CarFileSize, spec.pieceSize, cp.PieceSize)
+	}
+
+	p.PieceCID = cp.CommPCid
+	p.PieceSize = cp.PieceSize
+	p.CarSize = cp.CarFileSize
+	p.Created = time.Now()
+	p.Path = np
+	return nil
+}
+
+// reserveCarName creates an empty <root>.car in dir to move a CAR over, or a
+// <root>-<uuid>.car when the name is taken.
+func reserveCarName(dir, root string) (string, error) {
+	np := path.Join(dir, root+".car")
+	for {
+		f, err := os.OpenFile(np, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return np, f.Close()
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		np = path.Join(dir, root+"-"+uuid.NewString()+".car")
+	}
+}
+
+// isPieceCarName reports whether name is one reserveCarName gives.
+func isPieceCarName(name string) bool {
+	root, ok := strings.CutSuffix(name, ".car")
+	if !ok {
+		return false
+	}
+	if r, id, ok := strings.Cut(root, "-"); ok {
+		if _, err := uuid.Parse(id); err != nil {
+			return false
+		}
+		root = r
+	}
+	_, err := cid.Decode(root)
+	return err == nil
+}
+
+func dagParamsFromFlags(cctx *cli.Context) dagParams {
+	return dagParams{
+		Chunker:      cctx.String("chunker"),
+		Layout:       cctx.String("dag-layout"),
+		MaxLinks:     cctx.Int("max-links"),
+		RawLeaves:    cctx.Bool("raw-leaves"),
+		CidVersion:   cctx.Int("cid-version"),
+		HashFunction: cctx.String("hash"),
+		InlineLimit:  cctx.Int("inline-limit"),
+	}
+}
+
+func carFormatFromFlags(cctx *cli.Context) carFormat {
+	return carFormat{
+		Format:     cctx.String("car-format"),
+		IndexCodec: cctx.String("index-codec"),
+	}
+}
+
+func dirLayoutFromFlags(cctx *cli.Context, seed int64) dirLayout {
+	return dirLayout{
+		Files:    cctx.Int("dir-files"),
+		Depth:    cctx.Int("dir-depth"),
+		SizeDist: cctx.String("dir-size-dist"),
+		HAMT:     cctx.Bool("dir-hamt"),
+		Seed:     seed,
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/boost/cli/node"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-datastore"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
+)
+
+// pledgeRun builds, places and deals pieces in a pipeline of stages.
+type pledgeRun struct {
+	cctx      *cli.Context
+	api       api.Gateway
+	node      *node.Node
+	wallet    address.Address
+	ds        datastore.Datastore
+	providers *providerSet
+	space     *spaceGuard
+	carPath   string
+	retry     backoff
+
+	// pieces come from gen, or from take until it returns nil
+	gen  *pieceGenerator
+	take func(ctx context.Context) (*piece, error)
+	// giveBack returns a taken piece no proposal was sent for
+	giveBack func(p *piece)
+	cars     *carDir
+
+	total atomic.Int64
+	// the deals whose data was imported
+	lk    sync.Mutex
+	deals []*dealRecord
+}
+
+// dealJob is a piece on its way through the pipeline.
+type dealJob struct {
+	prov  *provider
+	size  int64
+	spec  pieceSpec
+	piece *piece
+}
+
+// run makes deals until every provider got its pledge or pieces run out.
+func (r *pledgeRun) run(ctx context.Context, buildWorkers, placeWorkers, dealWorkers int) error {
+	g, ctx := errgroup.WithContext(ctx)
+
+	jobs := make(chan *dealJob)
+	g.Go(func() error {
+		defer close(jobs)
+		return r.feed(ctx, jobs)
+	})
+
+	built := make(chan *dealJob)
+	r.stage(ctx, g, buildWorkers, jobs, built, r.build)
+	placed := make(chan *dealJob)
+	r.stage(ctx, g, placeWorkers, built, placed, r.place)
+	r.stage(ctx, g, dealWorkers, placed, nil, r.deal)
+
+	return g.Wait()
+}
+
+// stage starts workers passing the jobs of in through do and on to out.
+func (r *pledgeRun) stage(ctx context.Context, g *errgroup.Group, workers int, in <-chan *dealJob, out chan<- *dealJob, do func(context.Context, *dealJob) error) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		g.Go(func() error {
+			defer wg.Done()
+			for job := range in {
+				if err := do(ctx, job); err != nil {
+					return err
+				}
+				if out == nil {
+					continue
+				}
+				select {
+				case out <- job:
+				case <-ctx.Done():
+					r.abandon(job)
+				}
+			}
+			return nil
+		})
+	}
+	if out != nil {
+		g.Go(func() error {
+			wg.Wait()
+			close(out)
+			return nil
+		})
+	}
+}
+
+// feed starts pieces into the pipeline with their provider.
+func (r *pledgeRun) feed(ctx context.Context, jobs chan<- *dealJob) error {
+	for ctx.Err() == nil {
+		job := &dealJob{}
+		if r.gen != nil {
+			job.spec = r.gen.sample()
+			job.size = job.spec.size
+		} else {
+			p, err := r.take(ctx)
+			if err != nil {
+				return err
+			}
+			if p == nil {
+				if r.cars != nil {
+					log.Infow("every car has been used", "dir", r.cctx.String("from-dir"))
+				}
+				return nil
+			}
+			job.piece = p
+			job.size = p.Size
+		}
+
+		job.prov = r.providers.pick(job.size)
+		if job.prov == nil {
+			if job.piece != nil {
+				r.giveBack(job.piece)
+			}
+			return nil
+		}
+
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			r.abandon(job)
+		}
+	}
+	return ctx.Err()
+}
+
+// abandon drops a job no proposal was sent for.
+func (r *pledgeRun) abandon(job *dealJob) {
+	r.providers.done(job.prov, job.size, false)
+	if job.piece != nil {
+		r.giveBack(job.piece)
+	}
+}
+
+func (r *pledgeRun) build(ctx context.Context, job *dealJob) error {
+	if job.piece != nil {
+		return nil
+	}
+	p, err := r.gen.build(ctx, r.carPath, job.spec, r.space)
+	if err != nil {
+		r.abandon(job)
+		return err
+	}
+	job.piece = p
+	return nil
+}
+
+func (r *pledgeRun) place(ctx context.Context, job *dealJob) error {
+	if job.piece.PieceCID != "" {
+		return nil
+	}
+	if err := r.gen.place(job.piece, job.spec); err != nil {
+		r.abandon(job)
+		return err
+	}
+	return nil
+}
+
+func (r *pledgeRun) deal(ctx context.Context, job *dealJob) error {
+	p := job.piece
+	d := &dealRecord{
+		UUID:      uuid.New(),
+		Provider:  job.prov.addr.String(),
+		Wallet:    r.wallet.String(),
+		Root:      p.Root,
+		PieceCID:  p.PieceCID,
+		PieceSize: p.PieceSize,
+		CarSize:   p.CarSize,
+		Path:      p.Path,
+		Created:   time.Now(),
+	}
+	err := r.retry.do(ctx, fmt.Sprintf("proposing %s to %s", p.Root, job.prov.addr), func() error {
+		// the answer of a failed attempt may have got lost
+		if d.Stage == dealStageFailed {
+			bd, err := boostDeal(ctx, job.prov.boost, d.UUID)
+			if err != nil {
+				return transient(fmt.Errorf("looking up deal %s at boost: %w", d.UUID, err))
+			}
+			if bd != nil {
+				log.Infow("provider got the deal of a failed attempt", "uuid", d.UUID, "provider", d.Provider, "checkpoint", bd.Checkpoint)
+				return nil
+			}
+		}
+		err := runPledge(ctx, r.cctx, r.api, r.node, r.wallet, job.prov, r.ds, d)
+		if err != nil && d.Stage == dealStageProposed {
+			stage := dealStageRejected
+			if isTransient(err) {
+				stage = dealStageFailed
+			}
+			if err := d.advance(context.WithoutCancel(ctx), r.ds, stage, err); err != nil {
+				return err
+			}
+		}
+		return err
+	})
+	if err != nil && d.Stage != dealStageProposed && d.Stage != dealStageFailed {
+		r.abandon(job)
+		return err
+	}
+	if err != nil {
+		// the provider may have the deal, leave it to deals status
+		r.providers.done(job.prov, job.size, false)
+		ctx := context.WithoutCancel(ctx)
+		if err := d.advance(ctx, r.ds, dealStageUnresolved, err); err != nil {
+			log.Errorw("failed to record deal", "uuid", d.UUID, "err", err)
+		}
+		if err := r.keep(ctx, p, d); err != nil {
+			log.Errorw("failed to keep piece of unresolved deal", "uuid", d.UUID, "path", p.Path, "err", err)
+		}
+		return err
+	}
+	r.providers.done(job.prov, job.size, true)
+	r.total.Add(p.Size)
+
+	// see accepted deals through even when shutting down
+	ctx = context.WithoutCancel(ctx)
+	if err := d.advance(ctx, r.ds, dealStageAccepted, nil); err != nil {
+		return err
+	}
+	if err := r.keep(ctx, p, d); err != nil {
+		return err
+	}
+	if err := importData(ctx, job.prov.boost, d.UUID.String(), p.Path); err != nil {
+		if err := d.advance(ctx, r.ds, dealStageImportFailed, err); err != nil {
+			log.Errorw("failed to record deal", "uuid", d.UUID, "err", err)
+		}
+		return err
+	}
+	if err := d.advance(ctx, r.ds, dealStageImported, nil); err != nil {
+		return err
+	}
+	r.lk.Lock()
+	r.deals = append(r.deals, d)
+	r.lk.Unlock()
+	if r.cars != nil {
+		if err := r.cars.markUsed(ctx, p, carStatusImported, d.UUID); err != nil {
+			return fmt.Errorf("recording deal %s for %s: %w", d.UUID, p.Path, err)
+		}
+	}
+	return nil
+}
+
+// keep records the piece of a deal so it is neither reused nor removed.
+func (r *pledgeRun) keep(ctx context.Context, p *piece, d *dealRecord) error {
+	if err := markDealt(ctx, r.ds, p.Path, d.UUID); err != nil {
+		return fmt.Errorf("recording deal %s: %w", d.UUID, err)
+	}
+	tempFiles.untrack(p.Path, sidecarIndexPath(p.Path))
+	if r.cars != nil {
+		if err := r.cars.markUsed(ctx, p, carStatusProposed, d.UUID); err != nil {
+			return fmt.Errorf("recording deal %s for %s: %w", d.UUID, p.Path, err)
+		}
+	}
+	return nil
+}
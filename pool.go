@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+var poolFlag = &cli.StringFlag{
+	Name:  "pool",
+	Usage: "directory of pre-built pieces, if not specified, the pool in the repo is used",
+}
+
+func poolPath(cctx *cli.Context, repo string) string {
+	if cctx.IsSet("pool") {
+		return cctx.String("pool")
+	}
+	return path.Join(repo, "pool")
+}
+
+// The pool is a directory of CARs, each next to a manifest entry of the same
+// name.
+
+func manifestPath(carPath string) string {
+	return strings.TrimSuffix(carPath, ".car") + ".json"
+}
+
+// addToPool records a piece whose CAR is already in the pool.
+func addToPool(pool string, p *piece) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(pool, ".manifest-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint:errcheck
+	defer f.Close()           // nolint:errcheck
+
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), manifestPath(p.Path))
+}
+
+// listPool returns the pieces of the pool, oldest first.
+func listPool(pool string) ([]*piece, error) {
+	entries, err := filepath.Glob(path.Join(pool, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	pieces := make([]*piece, 0, len(entries))
+	for _, e := range entries {
+		b, err := os.ReadFile(e)
+		if errors.Is(err, fs.ErrNotExist) {
+			// taken in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var p piece
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, fmt.Errorf("manifest entry %s: %w", e, err)
+		}
+		p.Path = strings.TrimSuffix(e, ".json") + ".car"
+		if _, err := os.Stat(p.Path); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, &p)
+	}
+
+	sort.Slice(pieces, func(i, j int) bool {
+		return pieces[i].Created.Before(pieces[j].Created)
+	})
+	return pieces, nil
+}
+
+// takeFromPool moves the oldest piece of the pool into carPath, or returns nil
+// once the pool is empty.
+func takeFromPool(ctx context.Context, pool, carPath string, space *spaceGuard) (*piece, error) {
+	pieces, err := listPool(pool)
+	if err != nil {
+		return nil, err
+	}
+	renamed, err := sameFilesystem(pool, carPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range pieces {
+		var need int64
+		if !renamed {
+			need = p.CarSize
+			if fi, err := os.Stat(sidecarIndexPath(p.Path)); err == nil {
+				need += fi.Size()
+			}
+		}
+		release, err := space.admit(ctx, map[string]int64{carPath: need})
+		if err != nil {
+			return nil, err
+		}
+		claimed, err := claimFromPool(pool, carPath, p)
+		release()
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			return p, nil
+		}
+	}
+	log.Infow("pool has no pieces left", "pool", pool)
+	return nil, nil
+}
+
+// claimFromPool moves the CAR of a piece from the pool into carPath, unless
+// another run renamed it first.
+func claimFromPool(pool, carPath string, p *piece) (bool, error) {
+	np, err := reserveCarName(carPath, p.Root)
+	if err != nil {
+		return false, err
+	}
+	claimed := path.Join(pool, "."+filepath.Base(p.Path)+".tmp")
+	if err := os.Rename(p.Path, claimed); err != nil {
+		_ = os.Remove(np)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	// the piece stays in flight until the caller settles it
+	tempFiles.track(claimed, sidecarIndexPath(claimed), np, sidecarIndexPath(np))
+
+	if err := moveClaimed(pool, claimed, np, p); err != nil {
+		if rerr := unclaim(pool, claimed, np, p); rerr != nil {
+			log.Errorw("failed to put piece back into the pool", "root", p.Root, "err", rerr)
+		} else {
+			tempFiles.untrack(claimed, sidecarIndexPath(claimed), np, sidecarIndexPath(np))
+		}
+		return false, err
+	}
+	tempFiles.untrack(claimed, sidecarIndexPath(claimed))
+
+	log.Infow("piece taken from pool", "root", p.Root, "piece", p.PieceCID, "piece-size", p.PieceSize, "car-size", p.CarSize, "seed", p.Seed)
+	p.Path = np
+	return true, nil
+}
+
+// moveClaimed removes the entry of a claimed piece and moves its CAR and
+// sidecar index from the pool to np.
+func moveClaimed(pool, claimed, np string, p *piece) error {
+	if p.CarFormat == carFormatV2Sidecar {
+		err := os.Rename(sidecarIndexPath(p.Path), sidecarIndexPath(claimed))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Remove(manifestPath(p.Path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if p.CarFormat == carFormatV2Sidecar {
+		_, err := MoveFile(sidecarIndexPath(claimed), sidecarIndexPath(np))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	_, err := MoveFile(claimed, np)
+	return err
+}
+
+// unclaim puts a claimed piece whose move failed back into the pool, under a
+// name another piece may not have taken in the meantime.
+func unclaim(pool, claimed, np string, p *piece) error {
+	back, err := reserveCarName(pool, p.Root)
+	if err != nil {
+		return err
+	}
+	if p.CarFormat == carFormatV2Sidecar {
+		// the index may have made it to carPath, or only to its claimed name
+		_, err := MoveFile(sidecarIndexPath(np), sidecarIndexPath(back))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err = os.Rename(sidecarIndexPath(claimed), sidecarIndexPath(back))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(claimed, back); err != nil {
+		return err
+	}
+	_ = os.Remove(np)
+	p.Path = back
+	return addToPool(pool, p)
+}
+
+// returnToPool moves a piece taken from the pool back into it.
+func returnToPool(pool string, p *piece) error {
+	np, err := reserveCarName(pool, p.Root)
+	if err != nil {
+		return err
+	}
+	if p.CarFormat == carFormatV2Sidecar {
+		if _, err := MoveFile(sidecarIndexPath(p.Path), sidecarIndexPath(np)); err != nil {
+			return err
+		}
+	}
+	if _, err := MoveFile(p.Path, np); err != nil {
+		return err
+	}
+	tempFiles.untrack(p.Path, sidecarIndexPath(p.Path))
+
+	p.Path = np
+	return addToPool(pool, p)
+}
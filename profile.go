@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	profileRandom = "random"
+	profileZeros  = "zeros"
+	profileRepeat = "repeat"
+	profileText   = "text"
+	profileMix    = "mix"
+)
+
+var dataProfiles = []string{profileRandom, profileZeros, profileRepeat, profileText, profileMix}
+
+// repeatPoolBlocks is the number of distinct blocks the repeat profile copies.
+const repeatPoolBlocks = 16
+
+// textPageSize is the unit the text profile generates words in.
+const textPageSize = 64 << 10
+
+var textWords = strings.Fields(`
+the of and to in is that it was for on are as with his they at be this from
+have or by one had not but what all were when we there can an your which their
+said if do will each about how up out them then she many some so these would
+other into has more her two like him see time could no make than first been
+its who now people my made over did down only way find use may water long
+little very after words called just where most know get through back much
+before go good new write our used me man too any day same right look think
+also around another came come work three word must because does part even
+place well such here take why things help put years different away again off
+went old number great tell men say small every found still between name should
+home big give`)
+
+// newDataProfile returns the generator of the named profile, with blocks of
+// blockSize.
+func newDataProfile(name string, seed int64, blockSize int64, dupRatio float64) (io.ReaderAt, error) {
+	switch name {
+	case profileRandom:
+		return newRandomGenerator(seed), nil
+	case profileZeros:
+		return zeroGenerator{}, nil
+	case profileRepeat:
+		if dupRatio < 0 || dupRatio > 1 {
+			return nil, fmt.Errorf("duplicate ratio must be between 0 and 1: %v", dupRatio)
+		}
+		return &repeatGenerator{
+			seed:      uint64(seed),
+			blockSize: blockSize,
+			dupRatio:  dupRatio,
+			unique:    newRandomGenerator(seed),
+			pool:      newRandomGenerator(int64(mix64(uint64(seed), 1))),
+		}, nil
+	case profileText:
+		return &textGenerator{seed: uint64(seed)}, nil
+	case profileMix:
+		if dupRatio < 0 || dupRatio > 1 {
+			return nil, fmt.Errorf("duplicate ratio must be between 0 and 1: %v", dupRatio)
+		}
+		repeat, _ := newDataProfile(profileRepeat, seed, blockSize, dupRatio)
+		return &mixGenerator{
+			seed:      uint64(seed),
+			blockSize: blockSize,
+			profiles: []io.ReaderAt{
+				newRandomGenerator(seed),
+				zeroGenerator{},
+				repeat,
+				&textGenerator{seed: uint64(seed)},
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown data profile %q, must be one of: %s", name, strings.Join(dataProfiles, ", "))
+	}
+}
+
+// profileDedupes reports whether the named profile repeats whole blocks.
+func profileDedupes(name string, dupRatio float64) bool {
+	switch name {
+	case profileZeros, profileMix:
+		return true
+	case profileRepeat:
+		return dupRatio > 0
+	default:
+		return false
+	}
+}
+
+// mix64 is the splitmix64 finalizer of a and b.
+func mix64(a, b uint64) uint64 {
+	z := a + (b+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// readBlocks hands fill the parts of p at off, one blockSize aligned block at
+// a time.
+func readBlocks(p []byte, off int64, blockSize int64, fill func(p []byte, block int64, off int64)) {
+	for len(p) > 0 {
+		block, boff := off/blockSize, off%blockSize
+		n := min(int64(len(p)), blockSize-boff)
+		fill(p[:n], block, boff)
+		p = p[n:]
+		off += n
+	}
+}
+
+type zeroGenerator struct{}
+
+func (zeroGenerator) ReadAt(p []byte, _ int64) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// repeatGenerator copies dupRatio of its blocks from a small pool.
+type repeatGenerator struct {
+	seed      uint64
+	blockSize int64
+	dupRatio  float64
+	unique    *randomGenerator
+	pool      *randomGenerator
+}
+
+func (g *repeatGenerator) ReadAt(p []byte, off int64) (int, error) {
+	readBlocks(p, off, g.blockSize, func(p []byte, block int64, boff int64) {
+		h := mix64(g.seed, uint64(block))
+		if float64(h>>11)/(1<<53) < g.dupRatio {
+			src := int64(mix64(h, 0) % repeatPoolBlocks)
+			_, _ = g.pool.ReadAt(p, src*g.blockSize+boff)
+			return
+		}
+		_, _ = g.unique.ReadAt(p, block*g.blockSize+boff)
+	})
+	return len(p), nil
+}
+
+// textGenerator produces low-entropy text made of common English words.
+type textGenerator struct {
+	seed uint64
+}
+
+func (g *textGenerator) ReadAt(p []byte, off int64) (int, error) {
+	var page []byte
+	readBlocks(p, off, textPageSize, func(p []byte, block int64, boff int64) {
+		if page == nil {
+			page = make([]byte, textPageSize)
+		}
+		g.page(page, block)
+		copy(p, page[boff:])
+	})
+	return len(p), nil
+}
+
+func (g *textGenerator) page(buf []byte, index int64) {
+	state := mix64(g.seed, uint64(index))
+	n := 0
+	for n < len(buf) {
+		state = mix64(state, 0)
+		n += copy(buf[n:], textWords[state%uint64(len(textWords))])
+		if n == len(buf) {
+			break
+		}
+
+		// roughly one line break every 16 words
+		if state>>60 == 0 {
+			buf[n] = '\n'
+		} else {
+			buf[n] = ' '
+		}
+		n++
+	}
+}
+
+// mixGenerator picks one of the other profiles for every block.
+type mixGenerator struct {
+	seed      uint64
+	blockSize int64
+	profiles  []io.ReaderAt
+}
+
+func (g *mixGenerator) ReadAt(p []byte, off int64) (int, error) {
+	readBlocks(p, off, g.blockSize, func(p []byte, block int64, boff int64) {
+		h := mix64(mix64(g.seed, 2), uint64(block))
+		_, _ = g.profiles[h%uint64(len(g.profiles))].ReadAt(p, block*g.blockSize+boff)
+	})
+	return len(p), nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	bapi "github.com/filecoin-project/boost/api"
+	"github.com/filecoin-project/boost/cli/node"
+	"github.com/filecoin-project/boost/cmd"
+	"github.com/filecoin-project/boost/storagemarket/types/legacytypes"
+	"github.com/filecoin-project/boost/storagemarket/types/legacytypes/network"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	strategyRoundRobin       = "round-robin"
+	strategyWeighted         = "weighted"
+	strategyLeastOutstanding = "least-outstanding"
+)
+
+var providerStrategies = []string{strategyRoundRobin, strategyWeighted, strategyLeastOutstanding}
+
+// provider is a storage provider deals are made with, and what this run
+// pledged to it.
+type provider struct {
+	addr   address.Address
+	weight int
+	// api info of the boost node of the provider, empty for BOOST_API_INFO
+	boostInfo string
+	boost     bapi.Boost
+
+	// accounted by providerSet
+	pledged     int64
+	deals       int
+	outstanding int64
+	inflight    int
+	current     int
+
+	lk   sync.Mutex
+	info *peer.AddrInfo
+	ask  *legacytypes.StorageAsk
+	// concurrent lookups share the one that resolves the provider
+	resolving singleflight.Group
+}
+
+// providerSet distributes pieces among the providers with the strategy, until
+// every provider got max pledge, or a deal when there is no max.
+type providerSet struct {
+	lk        sync.Mutex
+	providers []*provider
+	strategy  string
+	maxPledge int64
+	next      int
+}
+
+// parseProviders parses providers given as <address>[=<weight>][@<api-info>],
+// where api-info is that of the boost node of the provider. Only a single
+// provider can do without it and use BOOST_API_INFO.
+func parseProviders(specs []string, strategy string, maxPledge int64) (*providerSet, error) {
+	switch strategy {
+	case strategyRoundRobin, strategyWeighted, strategyLeastOutstanding:
+	default:
+		return nil, fmt.Errorf("unknown provider strategy %q, must be one of: %s", strategy, strings.Join(providerStrategies, ", "))
+	}
+
+	s := &providerSet{strategy: strategy, maxPledge: maxPledge}
+	seen := map[address.Address]bool{}
+	for _, spec := range specs {
+		aw, info, hasInfo := strings.Cut(strings.TrimSpace(spec), "@")
+		a, w, hasWeight := strings.Cut(aw, "=")
+		maddr, err := address.NewFromString(a)
+		if err != nil {
+			return nil, fmt.Errorf("provider %q: %w", spec, err)
+		}
+		if seen[maddr] {
+			return nil, fmt.Errorf("provider %s is given more than once", maddr)
+		}
+		seen[maddr] = true
+		if hasInfo && info == "" {
+			return nil, fmt.Errorf("provider %s: empty boost api info", maddr)
+		}
+
+		weight := 1
+		if hasWeight {
+			weight, err = strconv.Atoi(w)
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("weight of provider %s must be a positive integer, got %q", maddr, w)
+			}
+		}
+		s.providers = append(s.providers, &provider{addr: maddr, weight: weight, boostInfo: info})
+	}
+	if len(s.providers) == 0 {
+		return nil, fmt.Errorf("no provider given")
+	}
+	if len(s.providers) > 1 {
+		for _, p := range s.providers {
+			if p.boostInfo == "" {
+				return nil, fmt.Errorf("provider %s has no boost api, give each of several providers as <address>@<api-info>", p.addr)
+			}
+		}
+	}
+	return s, nil
+}
+
+// connectBoost connects to the boost node of every provider.
+func (s *providerSet) connectBoost(ctx context.Context, cctx *cli.Context) (func(), error) {
+	var closers []func()
+	closeAll := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+	for _, p := range s.providers {
+		boost, closer, err := boostAPI(ctx, cctx, p.boostInfo)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("cant setup boost connection of provider %s: %w", p.addr, err)
+		}
+		p.boost = boost
+		closers = append(closers, closer)
+	}
+	return closeAll, nil
+}
+
+// boostNodes returns the boost node of each provider by its address.
+func (s *providerSet) boostNodes() map[string]bapi.Boost {
+	nodes := map[string]bapi.Boost{}
+	for _, p := range s.providers {
+		nodes[p.addr.String()] = p.boost
+	}
+	return nodes
+}
+
+func (s *providerSet) eligible(p *provider) bool {
+	if s.maxPledge > 0 {
+		return p.pledged+p.outstanding < s.maxPledge
+	}
+	return p.deals+p.inflight == 0
+}
+
+// pick chooses the provider of a piece of size bytes and counts the piece as
+// outstanding until done. It returns nil once no provider takes pieces.
+func (s *providerSet) pick(size int64) *provider {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	var picked *provider
+	switch s.strategy {
+	case strategyRoundRobin:
+		for i := range s.providers {
+			p := s.providers[(s.next+i)%len(s.providers)]
+			if s.eligible(p) {
+				picked = p
+				s.next = (s.next + i + 1) % len(s.providers)
+				break
+			}
+		}
+	case strategyWeighted:
+		// smooth weighted round robin, spreads the picks of heavy providers
+		// rather than making them in a row
+		total := 0
+		for _, p := range s.providers {
+			if !s.eligible(p) {
+				continue
+			}
+			p.current += p.weight
+			total += p.weight
+			if picked == nil || p.current > picked.current {
+				picked = p
+			}
+		}
+		if picked != nil {
+			picked.current -= total
+		}
+	case strategyLeastOutstanding:
+		for _, p := range s.providers {
+			if !s.eligible(p) {
+				continue
+			}
+			if picked == nil || p.outstanding < picked.outstanding ||
+				p.outstanding == picked.outstanding && p.pledged < picked.pledged {
+				picked = p
+			}
+		}
+	}
+
+	if picked != nil {
+		picked.outstanding += size
+		picked.inflight++
+	}
+	return picked
+}
+
+// done settles a piece picked for p, ok tells whether the deal was made.
+func (s *providerSet) done(p *provider, size int64, ok bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	p.outstanding -= size
+	p.inflight--
+	if ok {
+		p.pledged += size
+		p.deals++
+	}
+}
+
+func (s *providerSet) logTotals() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for _, p := range s.providers {
+		log.Infow("provider pledge", "provider", p.addr, "value", p.pledged, "deals", p.deals)
+	}
+}
+
+// lookup connects to the provider, resolving it the first time.
+func (p *provider) lookup(ctx context.Context, api api.Gateway, n *node.Node) (*peer.AddrInfo, error) {
+	p.lk.Lock()
+	info := p.info
+	p.lk.Unlock()
+
+	if info != nil {
+		if err := n.Host.Connect(ctx, *info); err != nil {
+			// look the provider up again next time, its addresses may have
+			// changed
+			p.lk.Lock()
+			if p.info == info {
+				p.info = nil
+			}
+			p.lk.Unlock()
+			return nil, transient(fmt.Errorf("failed to connect to peer %s: %w", info.ID, err))
+		}
+		return info, nil
+	}
+
+	v, err, _ := p.resolving.Do("", func() (interface{}, error) {
+		return p.resolve(ctx, api, n)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*peer.AddrInfo), nil
+}
+
+func (p *provider) resolve(ctx context.Context, api api.Gateway, n *node.Node) (*peer.AddrInfo, error) {
+	addrInfo, err := cmd.GetAddrInfo(ctx, api, p.addr)
+	if err != nil {
+		// the chain may be unreachable or the provider about to set its
+		// addresses
+		return nil, transient(fmt.Errorf("looking up provider %s: %w", p.addr, err))
+	}
+	log.Debugw("storage provider", "id", addrInfo.ID, "multiaddrs", addrInfo.Addrs, "addr", p.addr)
+
+	if err := n.Host.Connect(ctx, *addrInfo); err != nil {
+		return nil, transient(fmt.Errorf("failed to connect to peer %s: %w", addrInfo.ID, err))
+	}
+	x, err := n.Host.Peerstore().FirstSupportedProtocol(addrInfo.ID, DealProtocolv120)
+	if err != nil {
+		return nil, fmt.Errorf("getting protocols for peer %s: %w", addrInfo.ID, err)
+	}
+	if len(x) == 0 {
+		return nil, fmt.Errorf("boost client cannot make a deal with storage provider %s because it does not support protocol version 1.2.0", p.addr)
+	}
+
+	ask, err := queryAsk(ctx, n, addrInfo, p.addr)
+	if err != nil {
+		// the ask only serves to catch deals the provider would reject
+		log.Warnw("failed to get storage ask", "provider", p.addr, "err", err)
+	} else {
+		log.Infow("storage ask", "provider", p.addr, "price", types.FIL(ask.Price), "verified-price", types.FIL(ask.VerifiedPrice), "min-piece-size", ask.MinPieceSize, "max-piece-size", ask.MaxPieceSize)
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if ask != nil {
+		p.ask = ask
+	}
+	p.info = addrInfo
+	return addrInfo, nil
+}
+
+// checkAsk fails deals outside of the piece sizes the ask of the provider
+// accepts, and warns about a price below it.
+func (p *provider) checkAsk(pieceSize abi.PaddedPieceSize, price abi.TokenAmount, verified bool) error {
+	p.lk.Lock()
+	ask := p.ask
+	p.lk.Unlock()
+	if ask == nil {
+		return nil
+	}
+
+	if pieceSize < ask.MinPieceSize || pieceSize > ask.MaxPieceSize {
+		return fmt.Errorf("piece size %d is out of the %d to %d bytes provider %s accepts", pieceSize, ask.MinPieceSize, ask.MaxPieceSize, p.addr)
+	}
+	askPrice := ask.Price
+	if verified {
+		askPrice = ask.VerifiedPrice
+	}
+	if price.LessThan(askPrice) {
+		log.Warnw("storage price is below the ask of the provider", "provider", p.addr, "price", price, "ask", askPrice)
+	}
+	return nil
+}
+
+func queryAsk(ctx context.Context, n *node.Node, addrInfo *peer.AddrInfo, maddr address.Address) (*legacytypes.StorageAsk, error) {
+	s, err := n.Host.NewStream(ctx, addrInfo.ID, AskProtocolv110)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream to peer %s: %w", addrInfo.ID, err)
+	}
+	defer s.Close() // nolint:errcheck
+
+	var resp network.AskResponse
+	if err := doRpc(ctx, s, &network.AskRequest{Miner: maddr}, &resp); err != nil {
+		return nil, fmt.Errorf("send ask request rpc: %w", err)
+	}
+	if resp.Ask == nil || resp.Ask.Ask == nil {
+		return nil, fmt.Errorf("provider %s has no ask", maddr)
+	}
+	return resp.Ask.Ask, nil
+}
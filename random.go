@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// randomSegmentSize is the amount of data a generator worker fills at a time.
+const randomSegmentSize = 1 << 20
+
+// randomGenerator is a seekable AES-CTR keystream derived from a seed.
+type randomGenerator struct {
+	block cipher.Block
+}
+
+func newRandomGenerator(seed int64) *randomGenerator {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(seed))
+	key := sha256.Sum256(b[:])
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		// only fails on invalid key sizes
+		panic(err)
+	}
+	return &randomGenerator{block: block}
+}
+
+// ReadAt fills p with the keystream starting at off.
+func (g *randomGenerator) ReadAt(p []byte, off int64) (int, error) {
+	var iv [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(iv[8:], uint64(off/aes.BlockSize))
+	stream := cipher.NewCTR(g.block, iv[:])
+
+	if skip := off % aes.BlockSize; skip > 0 {
+		var discard [aes.BlockSize]byte
+		stream.XORKeyStream(discard[:skip], discard[:skip])
+	}
+
+	clear(p)
+	stream.XORKeyStream(p, p)
+	return len(p), nil
+}
+
+type segment struct {
+	data []byte
+	err  error
+}
+
+type segmentJob struct {
+	off int64
+	buf []byte
+	res chan segment
+}
+
+// parallelReader reads src in order while workers fill the segments ahead.
+type parallelReader struct {
+	segments chan chan segment
+	pool     sync.Pool
+
+	cur []byte
+	buf []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newParallelReader(src io.ReaderAt, size int64, workers int) *parallelReader {
+	if workers < 1 {
+		workers = 1
+	}
+
+	r := &parallelReader{
+		segments: make(chan chan segment, workers),
+		done:     make(chan struct{}),
+	}
+	r.pool.New = func() any {
+		return make([]byte, randomSegmentSize)
+	}
+
+	jobs := make(chan segmentJob)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				n, err := src.ReadAt(job.buf, job.off)
+				if err == io.EOF && n == len(job.buf) {
+					err = nil
+				}
+				job.res <- segment{data: job.buf[:n], err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(r.segments)
+		defer close(jobs)
+
+		for off := int64(0); off < size; off += randomSegmentSize {
+			n := min(int64(randomSegmentSize), size-off)
+			job := segmentJob{
+				off: off,
+				buf: r.pool.Get().([]byte)[:n],
+				res: make(chan segment, 1),
+			}
+
+			// queue the result slot first to keep segments in order
+			select {
+			case r.segments <- job.res:
+			case <-r.done:
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+func (r *parallelReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.buf != nil {
+			r.pool.Put(r.buf[:cap(r.buf)]) // nolint:staticcheck
+			r.buf = nil
+		}
+
+		res, ok := <-r.segments
+		if !ok {
+			return 0, io.EOF
+		}
+		seg := <-res
+		if seg.err != nil {
+			return 0, seg.err
+		}
+		r.cur, r.buf = seg.data, seg.data
+	}
+
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+func (r *parallelReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	return nil
+}
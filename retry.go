@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var retryFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "retries",
+		Usage: "number of times a proposal that failed to reach the provider or the node is sent again before its piece is given up",
+		Value: 5,
+	},
+	&cli.DurationFlag{
+		Name:  "retry-backoff",
+		Usage: "wait before the first retry of a proposal, doubled after every further failure",
+		Value: 10 * time.Second,
+	},
+	&cli.DurationFlag{
+		Name:  "retry-max-backoff",
+		Usage: "longest wait between retries of a proposal",
+		Value: 5 * time.Minute,
+	},
+	&cli.DurationFlag{
+		Name:  "proposal-timeout",
+		Usage: "how long to wait for the provider to answer a proposal",
+		Value: time.Minute,
+	},
+}
+
+// transientError is a failure to reach the provider or the node.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// transient marks err as worth retrying.
+func transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &transientError{err: err}
+}
+
+func isTransient(err error) bool {
+	var te *transientError
+	return errors.As(err, &te)
+}
+
+// backoff retries transient failures, waiting exponentially longer between
+// attempts.
+type backoff struct {
+	retries int
+	initial time.Duration
+	max     time.Duration
+}
+
+func newBackoff(cctx *cli.Context) (backoff, error) {
+	b := backoff{
+		retries: cctx.Int("retries"),
+		initial: cctx.Duration("retry-backoff"),
+		max:     cctx.Duration("retry-max-backoff"),
+	}
+	if b.retries < 0 {
+		return b, fmt.Errorf("retries must not be negative")
+	}
+	if b.initial <= 0 || b.max < b.initial {
+		return b, fmt.Errorf("retry backoff must be positive and at most the retry max backoff")
+	}
+	return b, nil
+}
+
+// do calls f until it succeeds, fails for good or the retries are used up.
+func (b backoff) do(ctx context.Context, what string, f func() error) error {
+	wait := b.initial
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		if attempt == b.retries {
+			return fmt.Errorf("%s failed %d times: %w", what, attempt+1, err)
+		}
+
+		log.Warnw("retrying", "what", what, "attempt", attempt+1, "retries", b.retries, "in", wait, "err", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		wait = min(2*wait, b.max)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+const (
+	sizeDistUniform   = "uniform"
+	sizeDistFixed     = "fixed"
+	sizeDistWeighted  = "weighted"
+	sizeDistNormal    = "normal"
+	sizeDistLognormal = "lognormal"
+	sizeDistLadder    = "ladder"
+)
+
+var sizeDists = []string{sizeDistUniform, sizeDistFixed, sizeDistWeighted, sizeDistNormal, sizeDistLognormal, sizeDistLadder}
+
+// sizeDistribution draws the payload size of every piece of a run.
+type sizeDistribution interface {
+	// sample returns the payload size of the next piece, and the padded piece
+	// size its CAR must fill or 0 if it may end up in any piece size.
+	sample(rng *rand.Rand) (int64, abi.PaddedPieceSize)
+	// String describes the distribution and its parameters.
+	String() string
+}
+
+// parseSizeDistribution parses a size distribution spec, a distribution name
+// optionally followed by a colon and its parameters:
+//
+//	uniform                    between min and max
+//	fixed:<size>               always size
+//	weighted:<size>=<w>,...    one of the sizes, picked in proportion to its weight
+//	normal:<mean>,<stddev>     normally distributed, clamped to min and max
+//	lognormal:<median>,<sigma> log-normally distributed, clamped to min and max
+//	ladder[:<piece>,...]       fills one of the padded piece sizes, by default
+//	                           every power of two whose unpadded size is
+//	                           between min and max
+//
+// Sizes accept units, e.g. 8GiB, fixed and weighted sizes must be between min
+// and max. Ladder pieces are filled with the largest payload whose CAR still
+// fits, which depends on params and layout.
+func parseSizeDistribution(spec string, minSize, maxSize int64, params dagParams, layout *dirLayout) (sizeDistribution, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	var args []string
+	if arg != "" {
+		args = strings.Split(arg, ",")
+	}
+
+	switch name {
+	case sizeDistUniform:
+		if len(args) != 0 {
+			return nil, fmt.Errorf("%s size distribution takes no parameters", name)
+		}
+		return uniformSizes{min: minSize, max: maxSize}, nil
+	case sizeDistFixed:
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s size distribution takes a size, e.g. fixed:8GiB", name)
+		}
+		size, err := parseBoundedSize(args[0], minSize, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		return fixedSize(size), nil
+	case sizeDistWeighted:
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s size distribution takes sizes and weights, e.g. weighted:1GiB=3,8GiB=1", name)
+		}
+		var d weightedSizes
+		for _, a := range args {
+			s, w, ok := strings.Cut(a, "=")
+			if !ok {
+				return nil, fmt.Errorf("weighted size %q is missing its weight", a)
+			}
+			size, err := parseBoundedSize(s, minSize, maxSize)
+			if err != nil {
+				return nil, err
+			}
+			weight, err := strconv.ParseFloat(w, 64)
+			if err != nil || weight <= 0 || math.IsInf(weight, 0) {
+				return nil, fmt.Errorf("weight of %s must be a positive number: %q", s, w)
+			}
+			d.sizes = append(d.sizes, size)
+			d.weights = append(d.weights, weight)
+			d.total += weight
+		}
+		return d, nil
+	case sizeDistNormal:
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s size distribution takes a mean and a standard deviation, e.g. normal:16GiB,4GiB", name)
+		}
+		mean, err := parsePositiveSize(args[0])
+		if err != nil {
+			return nil, err
+		}
+		stddev, err := units.RAMInBytes(args[1])
+		if err != nil || stddev < 0 {
+			return nil, fmt.Errorf("invalid standard deviation %q", args[1])
+		}
+		return normalSizes{mean: mean, stddev: stddev, min: minSize, max: maxSize}, nil
+	case sizeDistLognormal:
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s size distribution takes a median and a sigma, e.g. lognormal:4GiB,0.8", name)
+		}
+		median, err := parsePositiveSize(args[0])
+		if err != nil {
+			return nil, err
+		}
+		sigma, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || sigma < 0 || math.IsInf(sigma, 0) {
+			return nil, fmt.Errorf("sigma must be a non-negative number: %q", args[1])
+		}
+		return lognormalSizes{median: median, sigma: sigma, min: minSize, max: maxSize}, nil
+	case sizeDistLadder:
+		var pieces []abi.PaddedPieceSize
+		for _, a := range args {
+			ps, err := parsePositiveSize(a)
+			if err != nil {
+				return nil, err
+			}
+			pieces = append(pieces, abi.PaddedPieceSize(ps))
+		}
+		if len(args) == 0 {
+			// the CAR fills the unpadded piece, that is what min and max bound
+			for ps := abi.PaddedPieceSize(128); int64(ps.Unpadded()) <= maxSize; ps <<= 1 {
+				if int64(ps.Unpadded()) >= minSize {
+					pieces = append(pieces, ps)
+				}
+			}
+			if len(pieces) == 0 {
+				return nil, fmt.Errorf("no power of two piece size holds a car between %d and %d bytes", minSize, maxSize)
+			}
+		}
+
+		d := pieceLadder{pieces: pieces}
+		for _, ps := range pieces {
+			payload, err := payloadForPieceSize(ps, params, layout)
+			if err != nil {
+				return nil, fmt.Errorf("piece size %d: %w", ps, err)
+			}
+			d.payloads = append(d.payloads, payload)
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unknown size distribution %q, must be one of: %s", name, strings.Join(sizeDists, ", "))
+	}
+}
+
+func parsePositiveSize(s string) (int64, error) {
+	size, err := units.RAMInBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("size must be positive: %q", s)
+	}
+	return size, nil
+}
+
+// parseBoundedSize parses a size that must be between minSize and maxSize.
+func parseBoundedSize(s string, minSize, maxSize int64) (int64, error) {
+	size, err := parsePositiveSize(s)
+	if err != nil {
+		return 0, err
+	}
+	if size < minSize || size > maxSize {
+		return 0, fmt.Errorf("size %s is not between min size %s and max size %s", s,
+			units.BytesSize(float64(minSize)), units.BytesSize(float64(maxSize)))
+	}
+	return size, nil
+}
+
+func clampSize(size float64, minSize, maxSize int64) int64 {
+	return max(minSize, min(maxSize, int64(size)))
+}
+
+type uniformSizes struct {
+	min, max int64
+}
+
+func (d uniformSizes) sample(rng *rand.Rand) (int64, abi.PaddedPieceSize) {
+	return d.min + rng.Int63n(d.max-d.min+1), 0
+}
+
+func (d uniformSizes) String() string {
+	return fmt.Sprintf("uniform(min=%s, max=%s)", units.BytesSize(float64(d.min)), units.BytesSize(float64(d.max)))
+}
+
+type fixedSize int64
+
+func (d fixedSize) sample(*rand.Rand) (int64, abi.PaddedPieceSize) {
+	return int64(d), 0
+}
+
+func (d fixedSize) String() string {
+	return fmt.Sprintf("fixed(size=%s)", units.BytesSize(float64(d)))
+}
+
+type weightedSizes struct {
+	sizes   []int64
+	weights []float64
+	total   float64
+}
+
+func (d weightedSizes) sample(rng *rand.Rand) (int64, abi.PaddedPieceSize) {
+	r := rng.Float64() * d.total
+	for i, w := range d.weights {
+		if r < w {
+			return d.sizes[i], 0
+		}
+		r -= w
+	}
+	return d.sizes[len(d.sizes)-1], 0
+}
+
+func (d weightedSizes) String() string {
+	parts := make([]string, len(d.sizes))
+	for i := range d.sizes {
+		parts[i] = fmt.Sprintf("%s=%g", units.BytesSize(float64(d.sizes[i])), d.weights[i])
+	}
+	return fmt.Sprintf("weighted(%s)", strings.Join(parts, ", "))
+}
+
+type normalSizes struct {
+	mean, stddev int64
+	min, max     int64
+}
+
+func (d normalSizes) sample(rng *rand.Rand) (int64, abi.PaddedPieceSize) {
+	return clampSize(float64(d.mean)+rng.NormFloat64()*float64(d.stddev), d.min, d.max), 0
+}
+
+func (d normalSizes) String() string {
+	return fmt.Sprintf("normal(mean=%s, stddev=%s, min=%s, max=%s)",
+		units.BytesSize(float64(d.mean)), units.BytesSize(float64(d.stddev)),
+		units.BytesSize(float64(d.min)), units.BytesSize(float64(d.max)))
+}
+
+type lognormalSizes struct {
+	median   int64
+	sigma    float64
+	min, max int64
+}
+
+func (d lognormalSizes) sample(rng *rand.Rand) (int64, abi.PaddedPieceSize) {
+	return clampSize(float64(d.median)*math.Exp(rng.NormFloat64()*d.sigma), d.min, d.max), 0
+}
+
+func (d lognormalSizes) String() string {
+	return fmt.Sprintf("lognormal(median=%s, sigma=%g, min=%s, max=%s)",
+		units.BytesSize(float64(d.median)), d.sigma,
+		units.BytesSize(float64(d.min)), units.BytesSize(float64(d.max)))
+}
+
+// pieceLadder fills one of a set of padded piece sizes, picked uniformly.
+type pieceLadder struct {
+	pieces   []abi.PaddedPieceSize
+	payloads []int64
+}
+
+func (d pieceLadder) sample(rng *rand.Rand) (int64, abi.PaddedPieceSize) {
+	i := rng.Intn(len(d.pieces))
+	return d.payloads[i], d.pieces[i]
+}
+
+func (d pieceLadder) String() string {
+	parts := make([]string, len(d.pieces))
+	for i, ps := range d.pieces {
+		parts[i] = units.BytesSize(float64(ps))
+	}
+	return fmt.Sprintf("ladder(%s)", strings.Join(parts, ", "))
+}
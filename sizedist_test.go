@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+func TestParseSizeDistribution(t *testing.T) {
+	const minSize, maxSize = 1 << 20, 1 << 30
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"uniform", "uniform(min=1MiB, max=1GiB)"},
+		{"fixed:8MiB", "fixed(size=8MiB)"},
+		{"weighted:1MiB=3,1GiB=1", "weighted(1MiB=3, 1GiB=1)"},
+		{"normal:16MiB,4MiB", "normal(mean=16MiB, stddev=4MiB, min=1MiB, max=1GiB)"},
+		{"lognormal:4MiB,0.8", "lognormal(median=4MiB, sigma=0.8, min=1MiB, max=1GiB)"},
+		{"ladder", "ladder(2MiB, 4MiB, 8MiB, 16MiB, 32MiB, 64MiB, 128MiB, 256MiB, 512MiB, 1GiB)"},
+		{"ladder:1MiB,32GiB", "ladder(1MiB, 32GiB)"},
+	}
+	for _, tt := range tests {
+		d, err := parseSizeDistribution(tt.spec, minSize, maxSize, defaultDagParams(), nil)
+		if err != nil {
+			t.Errorf("%s: %s", tt.spec, err)
+			continue
+		}
+		if got := d.String(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+
+	invalid := []string{
+		"unknown",
+		"uniform:1MiB",
+		"fixed",
+		"fixed:0",
+		"fixed:512KiB",
+		"fixed:2GiB",
+		"weighted",
+		"weighted:1MiB",
+		"weighted:1MiB=0",
+		"weighted:1MiB=x",
+		"weighted:1MiB=1,4GiB=1",
+		"normal:16MiB",
+		"normal:16MiB,-1",
+		"lognormal:4MiB,-0.5",
+		"ladder:1000",
+	}
+	for _, spec := range invalid {
+		if _, err := parseSizeDistribution(spec, minSize, maxSize, defaultDagParams(), nil); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+
+	// no power of two piece holds a car between 600 and 1000 bytes
+	if _, err := parseSizeDistribution("ladder", 600, 1000, defaultDagParams(), nil); err == nil {
+		t.Error("ladder: expected an error without any piece between min and max")
+	}
+}
+
+func TestSizeDistributionSample(t *testing.T) {
+	const minSize, maxSize = 1 << 20, 1 << 30
+	const samples = 10000
+
+	parse := func(spec string) sizeDistribution {
+		d, err := parseSizeDistribution(spec, minSize, maxSize, defaultDagParams(), nil)
+		if err != nil {
+			t.Fatalf("%s: %s", spec, err)
+		}
+		return d
+	}
+	sample := func(d sizeDistribution, check func(size int64, ps abi.PaddedPieceSize)) {
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < samples; i++ {
+			check(d.sample(rng))
+		}
+	}
+	inBounds := func(spec string) func(int64, abi.PaddedPieceSize) {
+		return func(size int64, ps abi.PaddedPieceSize) {
+			if size < minSize || size > maxSize || ps != 0 {
+				t.Fatalf("%s: sampled %d for piece %d", spec, size, ps)
+			}
+		}
+	}
+
+	for _, spec := range []string{"uniform", "normal:16MiB,1GiB", "lognormal:4MiB,3"} {
+		sample(parse(spec), inBounds(spec))
+	}
+
+	sample(parse("fixed:8MiB"), func(size int64, ps abi.PaddedPieceSize) {
+		if size != 8<<20 || ps != 0 {
+			t.Fatalf("fixed: sampled %d for piece %d", size, ps)
+		}
+	})
+
+	counts := map[int64]int{}
+	sample(parse("weighted:1MiB=3,1GiB=1"), func(size int64, ps abi.PaddedPieceSize) {
+		counts[size]++
+	})
+	if len(counts) != 2 || math.Abs(float64(counts[1<<20])/samples-0.75) > 0.02 {
+		t.Errorf("weighted: sampled %v", counts)
+	}
+
+	var mean float64
+	sample(parse("normal:16MiB,1MiB"), func(size int64, _ abi.PaddedPieceSize) {
+		mean += float64(size) / samples
+	})
+	if math.Abs(mean-16<<20) > 64<<10 {
+		t.Errorf("normal: sampled mean %f", mean)
+	}
+
+	ladder := parse("ladder:1MiB,8MiB")
+	pieces := map[abi.PaddedPieceSize]int{}
+	sample(ladder, func(size int64, ps abi.PaddedPieceSize) {
+		pieces[ps]++
+		payload, err := payloadForPieceSize(ps, defaultDagParams(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != payload {
+			t.Fatalf("ladder: sampled %d for piece %d, want %d", size, ps, payload)
+		}
+	})
+	if len(pieces) != 2 || pieces[1<<20] < samples/3 || pieces[8<<20] < samples/3 {
+		t.Errorf("ladder: sampled pieces %v", pieces)
+	}
+}
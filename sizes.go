@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// Upper bounds of the bytes the protobuf and CAR framing add around the CIDs
+// and data they carry.
+const (
+	// length varint of a CAR section
+	carSectionOverhead = 10
+	// CARv2 pragma and header, and the CARv1 header less its root
+	carHeaderOverhead = 11 + 40 + 32
+	// CARv2 index codec and bucket headers
+	carIndexOverhead = 128
+	// dag-pb link less its CID and name: field tags, lengths and Tsize
+	pbLinkOverhead = 24
+	// UnixFS data of a node less its block sizes: type, file size, tags
+	unixfsNodeOverhead = 32
+	// UnixFS block size of a link
+	unixfsBlockSizeOverhead = 11
+	// HAMT shard data and link name prefix
+	hamtShardOverhead = 64
+)
+
+// estimateCARSize returns an upper bound of the CAR of size bytes of payload.
+func estimateCARSize(size int64, params dagParams, layout *dirLayout) (int64, error) {
+	prefix, err := params.cidPrefix()
+	if err != nil {
+		return 0, err
+	}
+	// the longest CID of the DAG is a CIDv1, even with CIDv0 raw leaves are v1
+	prefix.Version = 1
+	prefix.Codec = cid.Raw
+	c, err := prefix.Sum(nil)
+	if err != nil {
+		return 0, err
+	}
+	cidLen := int64(len(c.Bytes()))
+	dmh, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return 0, err
+	}
+	digestLen := int64(dmh.Length)
+
+	files := int64(1)
+	var dirs, nameLen int64
+	if layout != nil {
+		files = int64(layout.Files)
+		// every directory level holds at most one directory per file
+		dirs = 1 + files*int64(layout.Depth)
+		nameLen = int64(len(fmt.Sprintf("file-%06d", layout.Files)))
+	}
+
+	// every file may end with a partial chunk
+	minChunk, _ := params.chunkSizes()
+	leaves := ceilDiv(size, minChunk) + files
+
+	// nodes above the leaves of every file
+	var internal int64
+	if params.Layout == layoutBalanced {
+		for level := leaves; level > 1; {
+			level = ceilDiv(level, int64(params.MaxLinks))
+			internal += level
+		}
+		internal += files
+	} else {
+		internal = leaves + files
+	}
+
+	// directory nodes, with HAMT shards at most one per entry
+	var dirNodes int64
+	if layout != nil {
+		dirNodes = 2 * (files + dirs)
+	}
+
+	nodes := leaves + internal + dirNodes
+	// every node but the root is linked to once
+	links := nodes
+
+	est := int64(carHeaderOverhead) + cidLen + size
+	est += nodes * (carSectionOverhead + cidLen + unixfsNodeOverhead)
+	est += links * (cidLen + pbLinkOverhead + unixfsBlockSizeOverhead + nameLen)
+	est += dirNodes * hamtShardOverhead
+	est += carIndexOverhead + nodes*(digestLen+8)
+	return est, nil
+}
+
+// payloadForPieceSize returns the largest payload whose CAR is certain to fit
+// into a piece of the given padded size.
+func payloadForPieceSize(pieceSize abi.PaddedPieceSize, params dagParams, layout *dirLayout) (int64, error) {
+	if err := pieceSize.Validate(); err != nil {
+		return 0, err
+	}
+	limit := int64(pieceSize.Unpadded())
+
+	fits := func(size int64) (bool, error) {
+		est, err := estimateCARSize(size, params, layout)
+		return est <= limit, err
+	}
+
+	if ok, err := fits(1); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, fmt.Errorf("piece size %d is too small to hold any data", pieceSize)
+	}
+
+	// the estimate grows with the payload, search the largest one that fits
+	lo, hi := int64(1), limit
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		ok, err := fits(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, nil
+}
+
+func ceilDiv(a, b int64) int64 {
+	return int64(math.Ceil(float64(a) / float64(b)))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+// buildTestCAR generates size bytes of random payload into a CAR in a temp dir
+// and returns the size of the CAR.
+func buildTestCAR(t *testing.T, size int64, params dagParams, layout *dirLayout) int64 {
+	t.Helper()
+	gen, err := newDataProfile(profileRandom, 1, params.blockSize(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := generatedSource(context.Background(), gen, size, 2)
+
+	var cn string
+	if layout != nil {
+		_, cn, err = CreateDirectoryCAR(t.TempDir(), src, size, *layout, params, defaultCARFormat())
+	} else {
+		_, cn, err = CreateDenseCAR(t.TempDir(), src, params, defaultCARFormat())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(cn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.Size()
+}
+
+func TestEstimateCARSize(t *testing.T) {
+	chunkers := []string{"size-1024", "size-262144", "rabin-512-1024-2048", "buzhash"}
+	layouts := []string{layoutBalanced, layoutTrickle}
+	dirs := map[string]*dirLayout{
+		"file": nil,
+		"dir":  {Files: 7, Depth: 2, SizeDist: fileSizesPareto},
+		"hamt": {Files: 7, Depth: 1, SizeDist: fileSizesUniform, HAMT: true},
+	}
+	sizes := []int64{1, 1000, 300 << 10, 1<<20 + 1}
+
+	for _, chunker := range chunkers {
+		for _, dagLayout := range layouts {
+			for _, cidVersion := range []int{0, 1} {
+				for dirName, layout := range dirs {
+					params := defaultDagParams()
+					params.Chunker = chunker
+					params.Layout = dagLayout
+					params.MaxLinks = 8
+					params.CidVersion = cidVersion
+					params.RawLeaves = cidVersion == 1
+					if cidVersion == 0 {
+						params.HashFunction = "sha2-256"
+					}
+
+					name := fmt.Sprintf("%s/%s/v%d/%s", chunker, dagLayout, cidVersion, dirName)
+					t.Run(name, func(t *testing.T) {
+						for _, size := range sizes {
+							est, err := estimateCARSize(size, params, layout)
+							if err != nil {
+								t.Fatal(err)
+							}
+							if got := buildTestCAR(t, size, params, layout); got > est {
+								t.Errorf("payload %d: car is %d bytes, estimated at most %d", size, got, est)
+							}
+						}
+					})
+				}
+			}
+		}
+	}
+}
+
+func TestPayloadForPieceSize(t *testing.T) {
+	dirs := map[string]*dirLayout{
+		"file": nil,
+		"dir":  {Files: 20, Depth: 2, SizeDist: fileSizesEqual},
+	}
+	pieceSizes := []abi.PaddedPieceSize{256 << 10, 1 << 20, 8 << 20, 1 << 30, 32 << 30}
+
+	for dirName, layout := range dirs {
+		for _, ps := range pieceSizes {
+			t.Run(fmt.Sprintf("%s/%d", dirName, ps), func(t *testing.T) {
+				params := defaultDagParams()
+				payload, err := payloadForPieceSize(ps, params, layout)
+				if err != nil {
+					t.Fatal(err)
+				}
+				limit := int64(ps.Unpadded())
+				if 2*payload <= limit {
+					t.Errorf("payload %d fills at most half of the piece", payload)
+				}
+
+				// building the largest pieces takes too long
+				if ps > 8<<20 {
+					return
+				}
+				got := buildTestCAR(t, payload, params, layout)
+				if got > limit {
+					t.Errorf("car of %d bytes does not fit the piece, %d bytes unpadded", got, limit)
+				}
+				if 2*got <= limit {
+					t.Errorf("car of %d bytes fills at most half of the piece", got)
+				}
+			})
+		}
+	}
+
+	if _, err := payloadForPieceSize(128, defaultDagParams(), nil); err == nil {
+		t.Error("expected an error for a piece too small to hold any data")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	lowSpaceWait = "wait"
+	lowSpaceFail = "fail"
+)
+
+var spaceFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "min-free",
+		Usage: "free space to keep on the repo and car filesystems on top of what the next piece needs",
+		Value: "5GiB",
+	},
+	&cli.StringFlag{
+		Name:  "low-space",
+		Usage: "what to do when a filesystem lacks space for the next piece: wait until it is freed or fail",
+		Value: lowSpaceFail,
+	},
+	&cli.DurationFlag{
+		Name:  "space-check-interval",
+		Usage: "how often free space is checked again while waiting for it",
+		Value: time.Minute,
+	},
+}
+
+// spaceGuard admits pieces once their filesystems have room for them on top
+// of a reserve.
+type spaceGuard struct {
+	dirs     []string
+	minFree  int64
+	wait     bool
+	interval time.Duration
+
+	lk       sync.Mutex
+	reserved map[uint64]int64
+}
+
+func newSpaceGuard(cctx *cli.Context, dirs ...string) (*spaceGuard, error) {
+	minFree, err := units.RAMInBytes(cctx.String("min-free"))
+	if err != nil {
+		return nil, fmt.Errorf("min free: %w", err)
+	}
+	if minFree < 0 {
+		return nil, fmt.Errorf("min free must not be negative")
+	}
+
+	g := &spaceGuard{
+		reserved: map[uint64]int64{},
+		dirs:     dirs,
+		minFree:  minFree,
+		interval: cctx.Duration("space-check-interval"),
+	}
+	switch cctx.String("low-space") {
+	case lowSpaceWait:
+		g.wait = true
+	case lowSpaceFail:
+	default:
+		return nil, fmt.Errorf("unknown low space action %q, must be %s or %s", cctx.String("low-space"), lowSpaceWait, lowSpaceFail)
+	}
+	if g.wait && g.interval <= 0 {
+		return nil, fmt.Errorf("space check interval must be positive")
+	}
+	return g, nil
+}
+
+type spaceShortage struct {
+	dir     string
+	free    int64
+	need    int64
+	minFree int64
+}
+
+func (e *spaceShortage) Error() string {
+	return fmt.Sprintf("not enough space on the filesystem of %s: %s free, %s needed plus %s to keep free",
+		e.dir, units.BytesSize(float64(e.free)), units.BytesSize(float64(e.need)), units.BytesSize(float64(e.minFree)))
+}
+
+// admit reserves need once it is free, until release is called.
+func (g *spaceGuard) admit(ctx context.Context, need map[string]int64) (release func(), err error) {
+	for {
+		release, short, err := g.reserve(need)
+		if err != nil {
+			return nil, err
+		}
+		if short == nil {
+			return release, nil
+		}
+		if !g.wait {
+			return nil, short
+		}
+
+		log.Warnw("waiting for disk space", "dir", short.dir, "free", short.free, "need", short.need, "min-free", short.minFree, "retry-in", g.interval)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(g.interval):
+		}
+	}
+}
+
+func (g *spaceGuard) reserve(need map[string]int64) (func(), *spaceShortage, error) {
+	seen := map[string]bool{}
+	var dirs []string
+	for _, dir := range g.dirs {
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	for dir := range need {
+		if !seen[dir] {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+
+	// directories sharing a filesystem add up their needs
+	type filesystem struct {
+		dir  string
+		need int64
+	}
+	var order []uint64
+	byDev := map[uint64]*filesystem{}
+	for _, dir := range dirs {
+		dev, err := deviceOf(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		f, ok := byDev[dev]
+		if !ok {
+			f = &filesystem{dir: dir}
+			byDev[dev] = f
+			order = append(order, dev)
+		}
+		f.need += need[dir]
+	}
+
+	g.lk.Lock()
+	defer g.lk.Unlock()
+
+	for _, dev := range order {
+		f := byDev[dev]
+		free, err := freeSpace(f.dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		// what is written of admitted pieces is counted twice, as used and
+		// as reserved, which errs on the safe side
+		if need := f.need + g.reserved[dev]; free < need+g.minFree {
+			return nil, &spaceShortage{dir: f.dir, free: free, need: need, minFree: g.minFree}, nil
+		}
+	}
+
+	for _, dev := range order {
+		g.reserved[dev] += byDev[dev].need
+	}
+	return func() {
+		g.lk.Lock()
+		defer g.lk.Unlock()
+		for _, dev := range order {
+			g.reserved[dev] -= byDev[dev].need
+		}
+	}, nil, nil
+}
+
+// existingDir returns dir, or its closest parent that exists.
+func existingDir(dir string) (string, error) {
+	for {
+		_, err := os.Stat(dir)
+		if errors.Is(err, fs.ErrNotExist) && filepath.Dir(dir) != dir {
+			dir = filepath.Dir(dir)
+			continue
+		}
+		return dir, err
+	}
+}
+
+func deviceOf(dir string) (uint64, error) {
+	dir, err := existingDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("no device of %s", dir)
+	}
+	return uint64(st.Dev), nil // nolint:unconvert
+}
+
+// sameFilesystem reports whether a and b are on the same filesystem, so files
+// are renamed between them rather than copied.
+func sameFilesystem(a, b string) (bool, error) {
+	da, err := deviceOf(a)
+	if err != nil {
+		return false, err
+	}
+	db, err := deviceOf(b)
+	if err != nil {
+		return false, err
+	}
+	return da == db, nil
+}
+
+func freeSpace(dir string) (int64, error) {
+	dir, err := existingDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, fmt.Errorf("statfs %s: %w", dir, err)
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil // nolint:unconvert
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// tempFiles records the files this process has in flight in
+// <repo>/inflight/<pid>.json, for the next run or gc to sweep.
+var tempFiles = &tempTracker{files: map[string]struct{}{}}
+
+type tempTracker struct {
+	lk     sync.Mutex
+	record string
+	self   inflightRecord
+	files  map[string]struct{}
+}
+
+type inflightRecord struct {
+	PID int
+	// tell the process apart from a later one with its PID
+	BootID    string `json:",omitempty"`
+	StartTime uint64 `json:",omitempty"`
+	Files     []string
+}
+
+func inflightDir(repo string) string {
+	return path.Join(repo, "inflight")
+}
+
+func (t *tempTracker) open(repo string) error {
+	if err := os.MkdirAll(inflightDir(repo), 0755); err != nil {
+		return err
+	}
+
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.record = path.Join(inflightDir(repo), strconv.Itoa(os.Getpid())+".json")
+	t.self = inflightRecord{PID: os.Getpid()}
+	t.self.BootID, t.self.StartTime = processIdentity(os.Getpid())
+	return t.save()
+}
+
+func (t *tempTracker) track(paths ...string) {
+	t.update(func() {
+		for _, p := range paths {
+			t.files[absPath(p)] = struct{}{}
+		}
+	})
+}
+
+func (t *tempTracker) untrack(paths ...string) {
+	t.update(func() {
+		for _, p := range paths {
+			delete(t.files, absPath(p))
+		}
+	})
+}
+
+func (t *tempTracker) update(f func()) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	f()
+	if t.record == "" {
+		return
+	}
+	if err := t.save(); err != nil {
+		log.Warnw("failed to record temp files", "record", t.record, "err", err)
+	}
+}
+
+func (t *tempTracker) save() error {
+	r := t.self
+	r.Files = nil
+	for f := range t.files {
+		r.Files = append(r.Files, f)
+	}
+	sort.Strings(r.Files)
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	tmp := t.record + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.record)
+}
+
+// close stops recording, once nothing is in flight anymore.
+func (t *tempTracker) close() {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.record == "" {
+		return
+	}
+	if len(t.files) > 0 {
+		log.Warnw("temp files still in flight, left for the next sweep", "files", len(t.files))
+		return
+	}
+	if err := os.Remove(t.record); err != nil {
+		log.Warnw("failed to remove temp file record", "record", t.record, "err", err)
+	}
+	t.record = ""
+}
+
+// cleanup removes every file in flight, for when the process is terminated.
+func (t *tempTracker) cleanup() {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	for f := range t.files {
+		if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warnw("failed to remove temp file", "file", f, "err", err)
+			continue
+		}
+		delete(t.files, f)
+	}
+	if t.record != "" && len(t.files) == 0 {
+		_ = os.Remove(t.record)
+		t.record = ""
+	}
+}
+
+func absPath(p string) string {
+	if a, err := filepath.Abs(p); err == nil {
+		return a
+	}
+	return p
+}
+
+// inflightFiles returns the files and records of the processes that are gone,
+// and the files of the live ones.
+func inflightFiles(repo string) (stale, records []string, live map[string]bool, err error) {
+	entries, err := filepath.Glob(path.Join(inflightDir(repo), "*.json"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	live = map[string]bool{}
+	for _, e := range entries {
+		b, err := os.ReadFile(e)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		var r inflightRecord
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, nil, nil, fmt.Errorf("temp file record %s: %w", e, err)
+		}
+
+		if r.PID != os.Getpid() && processAlive(r) {
+			for _, f := range r.Files {
+				live[f] = true
+			}
+			continue
+		}
+		stale = append(stale, r.Files...)
+		records = append(records, e)
+	}
+	return stale, records, live, nil
+}
+
+// processAlive reports whether the process of a record still runs.
+func processAlive(r inflightRecord) bool {
+	err := syscall.Kill(r.PID, 0)
+	if err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+	if r.BootID == "" {
+		// recorded without /proc, the PID is all there is to go by
+		return true
+	}
+	bootID, startTime := processIdentity(r.PID)
+	return bootID == r.BootID && startTime == r.StartTime
+}
+
+// processIdentity returns the boot id and the start time of a process.
+func processIdentity(pid int) (string, uint64) {
+	b, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", 0
+	}
+	bootID := strings.TrimSpace(string(b))
+
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return bootID, 0
+	}
+	// the command may hold spaces, the start time is field 22
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 20 {
+		return bootID, 0
+	}
+	startTime, _ := strconv.ParseUint(fields[19], 10, 64)
+	return bootID, startTime
+}
+
+// sweepTempFiles removes the files in flight of processes that are gone.
+func sweepTempFiles(repo string) ([]string, error) {
+	stale, records, _, err := inflightFiles(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, f := range stale {
+		err := os.Remove(f)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, f)
+	}
+	for _, r := range records {
+		if err := os.Remove(r); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// isTempName reports whether name is that of a temp file pledge writes.
+func isTempName(name string) bool {
+	for _, prefix := range []string{"source.dat", "rand"} {
+		if digits, ok := strings.CutPrefix(name, prefix); ok {
+			_, err := strconv.ParseUint(digits, 10, 64)
+			return err == nil
+		}
+	}
+	// staged CARs and their sidecars, pool manifests being written
+	if strings.HasPrefix(name, ".pledge-") && (strings.HasSuffix(name, ".car.tmp") || strings.HasSuffix(name, ".car.tmp.idx")) {
+		return true
+	}
+	if strings.HasPrefix(name, ".manifest-") && strings.HasSuffix(name, ".tmp") {
+		return true
+	}
+
+	// staged copies and claimed pool pieces of placed CARs
+	rest, ok := strings.CutPrefix(name, ".")
+	if !ok {
+		return false
+	}
+	rest = strings.TrimSuffix(rest, ".idx")
+	if rest, ok = strings.CutSuffix(rest, ".tmp"); !ok {
+		return false
+	}
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+		if _, err := strconv.ParseUint(rest[i+1:], 10, 64); err == nil {
+			rest = rest[:i]
+		}
+	}
+	return isPieceCarName(strings.TrimSuffix(rest, ".idx"))
+}
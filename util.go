@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"os"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/filecoin-project/go-state-types/big"
@@ -14,29 +18,21 @@ import (
 
 	"github.com/filecoin-project/boost/cli/node"
 	cborutil "github.com/filecoin-project/go-cbor-util"
-	"github.com/filecoin-project/go-commp-utils/writer"
 	"github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/chain/messagesigner"
 	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/ipfs/boxo/blockservice"
-	bstore "github.com/ipfs/boxo/blockstore"
 	"github.com/ipfs/boxo/exchange/offline"
-	"github.com/ipfs/boxo/files"
 	"github.com/ipfs/boxo/ipld/merkledag"
-	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
 	ihelper "github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
 	"github.com/ipfs/go-cid"
-	"github.com/ipfs/go-cidutil"
-	"github.com/ipfs/go-cidutil/cidenc"
 	"github.com/ipfs/go-datastore"
-	ds "github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
 	chunk "github.com/ipfs/go-ipfs-chunker"
 	ipldformat "github.com/ipfs/go-ipld-format"
 	"github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/blockstore"
 	inet "github.com/libp2p/go-libp2p/core/network"
-	"github.com/multiformats/go-multibase"
 	"github.com/multiformats/go-multihash"
 )
 
@@ -46,138 +42,200 @@ const (
 	unixfsLinksPerLevel = 1024
 )
 
-func CreateRandomFile(dir string, size int64) (string, error) {
-	source := io.LimitReader(rand.New(rand.NewSource(time.Now().Unix())), size)
-	file, err := os.CreateTemp(dir, "source.dat")
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
+// dataSource opens a reader over the payload of a DAG.
+type dataSource func() (io.ReadCloser, error)
 
-	_, err = io.Copy(file, source)
-	if err != nil {
-		return "", err
-	}
-
-	_, err = file.Seek(0, io.SeekStart)
-	if err != nil {
-		return "", err
+// generatedSource streams the first size bytes of gen until ctx is done.
+func generatedSource(ctx context.Context, gen io.ReaderAt, size int64, workers int) dataSource {
+	return func() (io.ReadCloser, error) {
+		return ctxReader{ctx: ctx, ReadCloser: newParallelReader(gen, size, workers)}, nil
 	}
+}
 
-	return file.Name(), nil
+type ctxReader struct {
+	ctx context.Context
+	io.ReadCloser
 }
 
-func CreateDenseCARv2(dir, src string) (cid.Cid, string, error) {
-	cs := int64(unixfsChunkSize)
-	maxLinks := unixfsLinksPerLevel
-	carOpts := []car.Option{
-		blockstore.UseWholeCIDs(true),
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
 	}
-	return CreateDenseCARWith(dir, src, cs, maxLinks, carOpts)
+	return r.ReadCloser.Read(p)
 }
 
-func CreateDenseCARWith(dir, src string, chunkSize int64, maxLinks int, carOpts []car.Option) (cid.Cid, string, error) {
-	bs := bstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
-	dagSvc := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+// dagWriter writes a complete DAG into a DAG service and returns its root.
+type dagWriter func(into ipldformat.DAGService) (cid.Cid, error)
 
-	root, err := WriteUnixfsDAGTo(src, dagSvc, chunkSize, maxLinks)
+func CreateDenseCAR(dir string, src dataSource, params dagParams, format carFormat) (cid.Cid, string, error) {
+	return CreateDenseCARWith(dir, unixfsFileDAG(src, params), params, format)
+}
+
+// CreateDenseCARWith writes the DAG of write into a CAR in a single pass, with
+// a placeholder root patched once the root is known.
+func CreateDenseCARWith(dir string, write dagWriter, params dagParams, format carFormat) (cid.Cid, string, error) {
+	carOpts, err := format.options()
 	if err != nil {
 		return cid.Undef, "", err
 	}
 
-	// Create a UnixFS DAG again AND generate a CARv2 file using a CARv2
-	// read-write blockstore now that we have the root.
-	out, err := os.CreateTemp(dir, "rand")
+	prefix, err := params.cidPrefix()
 	if err != nil {
 		return cid.Undef, "", err
 	}
+	placeholder, err := prefix.Sum(nil)
+	if err != nil {
+		return cid.Undef, "", err
+	}
+
+	out, err := os.CreateTemp(dir, ".pledge-*.car.tmp")
+	if err != nil {
+		return cid.Undef, "", err
+	}
+	// in flight until the caller moves it into place
+	tempFiles.track(out.Name(), sidecarIndexPath(out.Name()))
 	err = out.Close()
 	if err != nil {
 		return cid.Undef, "", err
 	}
 
-	rw, err := blockstore.OpenReadWrite(out.Name(), []cid.Cid{root}, carOpts...)
+	rw, err := blockstore.OpenReadWrite(out.Name(), []cid.Cid{placeholder}, carOpts...)
 	if err != nil {
+		_ = os.Remove(out.Name())
+		tempFiles.untrack(out.Name(), sidecarIndexPath(out.Name()))
 		return cid.Undef, "", err
 	}
 
-	dagSvc = merkledag.NewDAGService(blockservice.New(rw, offline.Exchange(rw)))
+	dagSvc := merkledag.NewDAGService(blockservice.New(rw, offline.Exchange(rw)))
 
-	root2, err := WriteUnixfsDAGTo(src, dagSvc, chunkSize, maxLinks)
+	root, err := write(dagSvc)
 	if err != nil {
+		rw.Discard()
+		_ = os.Remove(out.Name())
+		tempFiles.untrack(out.Name(), sidecarIndexPath(out.Name()))
 		return cid.Undef, "", err
 	}
 
 	err = rw.Finalize()
+	if err == nil {
+		err = replaceCARRoot(out.Name(), placeholder, root, carOpts)
+	}
+	if err == nil && format.Format == carFormatV2Sidecar {
+		err = detachCARIndex(out.Name())
+	}
 	if err != nil {
+		_ = os.Remove(sidecarIndexPath(out.Name()))
+		_ = os.Remove(out.Name())
+		tempFiles.untrack(out.Name(), sidecarIndexPath(out.Name()))
 		return cid.Undef, "", err
 	}
 
-	if root != root2 {
-		return cid.Undef, "", fmt.Errorf("DAG root cid mismatch")
-	}
-
 	return root, out.Name(), nil
 }
 
-func WriteUnixfsDAGTo(path string, into ipldformat.DAGService, chunkSize int64, maxLinks int) (cid.Cid, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return cid.Undef, err
+// replaceCARRoot swaps the placeholder root of a finalized CAR for root.
+func replaceCARRoot(path string, placeholder, root cid.Cid, carOpts []car.Option) error {
+	if len(placeholder.Bytes()) == len(root.Bytes()) {
+		return car.ReplaceRootsInFile(path, []cid.Cid{root})
 	}
-	defer file.Close() // nolint:errcheck
 
-	stat, err := file.Stat()
+	tmp := path + ".root"
+	rw, err := blockstore.OpenReadWrite(tmp, []cid.Cid{root}, carOpts...)
 	if err != nil {
-		return cid.Undef, err
+		return err
 	}
+	defer os.Remove(tmp) // nolint:errcheck
 
-	rpf, err := files.NewReaderPathFile(file.Name(), file, stat)
+	f, err := os.Open(path)
 	if err != nil {
-		return cid.Undef, err
+		rw.Discard()
+		return err
 	}
+	defer f.Close() // nolint:errcheck
 
-	prefix, err := merkledag.PrefixForCidVersion(1)
+	br, err := car.NewBlockReader(f)
 	if err != nil {
-		return cid.Undef, err
+		rw.Discard()
+		return err
+	}
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rw.Discard()
+			return err
+		}
+		if err := rw.Put(context.Background(), blk); err != nil {
+			rw.Discard()
+			return err
+		}
+	}
+
+	if err := rw.Finalize(); err != nil {
+		return err
 	}
 
-	prefix.MhType = defaultHashFunction
+	return os.Rename(tmp, path)
+}
 
-	bufferedDS := ipldformat.NewBufferedDAG(context.Background(), into)
-	params := ihelper.DagBuilderParams{
-		Maxlinks:  maxLinks,
-		RawLeaves: true,
-		// NOTE: InlineBuilder not recommended, we are using this to test identity CIDs
-		CidBuilder: cidutil.InlineBuilder{
-			Builder: prefix,
-			Limit:   126,
-		},
-		Dagserv: bufferedDS,
-		NoCopy:  true,
+// unixfsFileDAG imports src as a single UnixFS file.
+func unixfsFileDAG(src dataSource, params dagParams) dagWriter {
+	return func(into ipldformat.DAGService) (cid.Cid, error) {
+		r, err := src()
+		if err != nil {
+			return cid.Undef, err
+		}
+		defer r.Close() // nolint:errcheck
+
+		return WriteUnixfsDAGTo(r, into, params)
 	}
+}
 
-	db, err := params.New(chunk.NewSizeSplitter(rpf, chunkSize))
+func WriteUnixfsDAGTo(r io.Reader, into ipldformat.DAGService, params dagParams) (cid.Cid, error) {
+	nd, err := writeUnixfsFile(r, into, params)
 	if err != nil {
 		return cid.Undef, err
 	}
+	return nd.Cid(), nil
+}
 
-	nd, err := balanced.Layout(db)
+func writeUnixfsFile(r io.Reader, into ipldformat.DAGService, params dagParams) (ipldformat.Node, error) {
+	builder, err := params.cidBuilder()
 	if err != nil {
-		return cid.Undef, err
+		return nil, err
 	}
 
-	err = bufferedDS.Commit()
+	spl, err := chunk.FromString(r, params.Chunker)
 	if err != nil {
-		return cid.Undef, err
+		return nil, err
+	}
+
+	bufferedDS := ipldformat.NewBufferedDAG(context.Background(), into)
+	dbp := ihelper.DagBuilderParams{
+		Maxlinks:   params.MaxLinks,
+		RawLeaves:  params.RawLeaves,
+		CidBuilder: builder,
+		Dagserv:    bufferedDS,
 	}
 
-	err = rpf.Close()
+	db, err := dbp.New(spl)
 	if err != nil {
-		return cid.Undef, err
+		return nil, err
 	}
 
-	return nd.Cid(), nil
+	nd, err := params.layout(db)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bufferedDS.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return nd, nil
 }
 
 type commpResult struct {
@@ -186,10 +244,10 @@ type commpResult struct {
 	CarFileSize int64
 }
 
-func commP(filePath string) (*commpResult, error) {
+func commP(filePath string, workers int) (*commpResult, error) {
 	start := time.Now()
 	defer func() {
-		log.Infow("calculate commP", "file", filePath, "duration", time.Since(start))
+		log.Infow("calculate commP", "file", filePath, "workers", workers, "duration", time.Since(start))
 	}()
 	rdr, err := os.Open(filePath)
 	if err != nil {
@@ -202,32 +260,36 @@ func commP(filePath string) (*commpResult, error) {
 		}
 	}(rdr)
 
-	w := &writer.Writer{}
-	_, err = io.CopyBuffer(w, rdr, make([]byte, writer.CommPBuf))
-	if err != nil {
-		return nil, err
-	}
-	cp, err := w.Sum()
+	w := newCommPWriter(workers)
+	_, err = io.CopyBuffer(w, rdr, make([]byte, 1<<20))
 	if err != nil {
 		return nil, err
 	}
+	return w.result()
+}
 
-	encoder := cidenc.Encoder{Base: multibase.MustNewEncoder(multibase.Base32)}
+// moveFileCommP moves a CAR like MoveFile and calculates its piece commitment.
+func moveFileCommP(sourcePath, destPath string, workers int) (*commpResult, error) {
+	start := time.Now()
+	defer func() {
+		log.Infow("move file and calculate commP", "file", destPath, "workers", workers, "duration", time.Since(start))
+	}()
 
-	stat, err := os.Stat(filePath)
+	w := newCommPWriter(workers)
+	copied, err := MoveFile(sourcePath, destPath, w)
 	if err != nil {
 		return nil, err
 	}
-
-	return &commpResult{
-		CommPCid:    encoder.Encode(cp.PieceCID),
-		PieceSize:   uint64(cp.PieceSize.Unpadded().Padded()),
-		CarFileSize: stat.Size(),
-	}, nil
+	if !copied {
+		// renamed, the CAR is read for the first time here
+		return commP(destPath, workers)
+	}
+	return w.result()
 }
 
 func doRpc(ctx context.Context, s inet.Stream, req interface{}, resp interface{}) error {
-	errc := make(chan error)
+	// buffered so the goroutine does not leak when ctx is done first
+	errc := make(chan error, 1)
 	go func() {
 		if err := cborutil.WriteCborRPC(s, req); err != nil {
 			errc <- fmt.Errorf("failed to send request: %w", err)
@@ -294,33 +356,102 @@ func SignAndPushToMpool(ctx context.Context, nodeAPI api.Gateway, n *node.Node,
 	return
 }
 
-func MoveFile(sourcePath, destPath string) error {
+// renameFile is replaced by tests.
+var renameFile = os.Rename
+
+// MoveFile moves sourcePath to destPath, copying across filesystems with the
+// copied bytes also written to tees.
+func MoveFile(sourcePath, destPath string, tees ...io.Writer) (copied bool, err error) {
+	// files are staged with os.CreateTemp, give them the mode os.Create would
+	if err := os.Chmod(sourcePath, 0644); err != nil {
+		return false, err
+	}
+	if err := syncFile(sourcePath); err != nil {
+		return false, err
+	}
+
+	err = renameFile(sourcePath, destPath)
+	if errors.Is(err, syscall.EXDEV) {
+		return true, copyFileAtomic(sourcePath, destPath, tees...)
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, syncFile(filepath.Dir(destPath))
+}
+
+// copyFileAtomic copies sourcePath next to destPath and renames it into place.
+func copyFileAtomic(sourcePath, destPath string, tees ...io.Writer) error {
 	inputFile, err := os.Open(sourcePath)
 	if err != nil {
 		return err
 	}
 	defer inputFile.Close() // nolint:errcheck
 
-	outputFile, err := os.Create(destPath) // nolint:gosec
+	staged, err := os.CreateTemp(filepath.Dir(destPath), "."+filepath.Base(destPath)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	defer outputFile.Close() // nolint:errcheck
+	tempFiles.track(staged.Name())
+	defer func() {
+		_ = staged.Close()
+		if err != nil {
+			_ = os.Remove(staged.Name())
+		}
+		tempFiles.untrack(staged.Name())
+	}()
 
-	_, err = io.Copy(outputFile, inputFile)
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(append([]io.Writer{staged, sum}, tees...)...), inputFile)
+	if err != nil {
+		return err
+	}
+	err = staged.Sync()
 	if err != nil {
 		return err
 	}
 
-	err = outputFile.Sync()
+	// verify the copy read from disk, not the page cache
+	err = dropPageCache(staged)
+	if err != nil {
+		return err
+	}
+	_, err = staged.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	check := sha256.New()
+	_, err = io.Copy(check, staged)
 	if err != nil {
 		return err
 	}
+	if !bytes.Equal(sum.Sum(nil), check.Sum(nil)) {
+		err = fmt.Errorf("checksum mismatch copying %s to %s", sourcePath, destPath)
+		return err
+	}
 
-	err = os.Remove(sourcePath)
+	err = staged.Chmod(0644)
 	if err != nil {
 		return err
 	}
+	err = os.Rename(staged.Name(), destPath)
+	if err != nil {
+		return err
+	}
+	err = syncFile(filepath.Dir(destPath))
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(sourcePath)
+}
 
-	return nil
+// syncFile flushes a file, or the entries of a directory, to disk.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint:errcheck
+	return f.Sync()
 }
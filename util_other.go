@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// dropPageCache is only done on linux, elsewhere f is read from the cache.
+func dropPageCache(f *os.File) error {
+	return nil
+}
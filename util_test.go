@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// crossDevice makes MoveFile copy files as if source and destination were on
+// different filesystems.
+func crossDevice(t *testing.T) {
+	t.Helper()
+	renameFile = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	t.Cleanup(func() { renameFile = os.Rename })
+}
+
+func TestMoveFileCommPCopy(t *testing.T) {
+	crossDevice(t)
+
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "staged.car"), filepath.Join(dir, "piece.car")
+	data := testCommPData(3<<20 + 17)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := moveFileCommP(src, dst, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(src); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("source still exists after the move: %v", err)
+	}
+	moved, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(moved, data) {
+		t.Fatal("moved file differs from the source")
+	}
+	st, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0644 {
+		t.Errorf("moved file has mode %s, want 0644", st.Mode().Perm())
+	}
+
+	want, err := commP(dst, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *want {
+		t.Errorf("commP of the copy is %+v, want %+v", got, want)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the moved file to be left, found %d files", len(entries))
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestMoveFileCopyFailure(t *testing.T) {
+	crossDevice(t)
+
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "staged.car"), filepath.Join(dir, "piece.car")
+	if err := os.WriteFile(src, testCommPData(1<<20), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MoveFile(src, dst, failingWriter{}); err == nil {
+		t.Fatal("expected the failed copy to fail the move")
+	}
+	if _, err := os.Stat(dst); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("failed copy shows up under the destination: %v", err)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("failed copy lost the source: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected the staged copy to be removed, found %d files", len(entries))
+	}
+}